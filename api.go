@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	"gopkg.in/resty.v1"
+)
+
+var errKamateraNotFound = errors.New("Kamatera resource not found")
+
+var errKamateraServerNotFound = errors.New("Failed to find Kamatera server ID")
+
+// apiRequest returns a Kamatera API request with the authentication headers
+func (d *Driver) apiRequest() (*resty.Request, error) {
+	clientID, secret, err := d.apiCredentials()
+	if err != nil {return nil, err}
+	return resty.R().SetHeader("AuthClientId", clientID).SetHeader("AuthSecret", secret), nil
+}
+
+// apiCall runs a Kamatera API request, retrying on invalid status codes up to 10 times,
+// a 404 status returns errKamateraNotFound
+func (d *Driver) apiCall(operation string, do func(req *resty.Request) (*resty.Response, error)) (*resty.Response, error) {
+	i := 0
+	for {
+		log.Debugf("Kamatera %s (%s): %d", operation, time.Now(), i)
+		if i > 0 {time.Sleep(time.Duration(2000 + i * 3000) * time.Millisecond)}
+		i += 1
+		req, err := d.apiRequest()
+		if err != nil {return nil, err}
+		resp, err := do(req)
+		if err != nil {return nil, errors.Wrapf(err, "Failed to run Kamatera %s", operation)}
+		if resp.StatusCode() != 200 {
+			if resp.StatusCode() == 404 {
+				return resp, errKamateraNotFound
+			}
+			if resp.StatusCode() == 500 {
+				return resp, errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", d.redact(resp.String())))
+			}
+			log.Info(d.redact(resp.String()))
+			if i >= 10 {
+				return resp, errors.New(fmt.Sprintf("Invalid Kamatera %s status: %d", operation, resp.StatusCode()))
+			}
+			log.Infof("Got invalid status code: %d, retrying... %d/10", resp.StatusCode(), i)
+			continue
+		}
+		log.Debug(d.redact(resp.String()))
+		return resp, nil
+	}
+}
+
+// parseCommandIds parses the Kamatera queue command IDs returned by asynchronous operations,
+// either a single ID or a list of IDs
+func parseCommandIds(body []byte) ([]int, error) {
+	var commandId int
+	if err := json.Unmarshal(body, &commandId); err == nil {
+		return []int{commandId}, nil
+	}
+	var commandIds []int
+	if err := json.Unmarshal(body, &commandIds); err != nil {
+		return nil, errors.Wrap(err, "Invalid Kamatera command ID response")
+	}
+	return commandIds, nil
+}
+
+// waitForCommand waits for a Kamatera queue command to complete
+func (d *Driver) waitForCommand(operation string, commandId int) error {
+	return d.waitForCommandTimeout(operation, commandId, 0)
+}
+
+// waitForCommandTimeout waits for a Kamatera queue command to complete, up to timeout (0 waits indefinitely)
+func (d *Driver) waitForCommandTimeout(operation string, commandId int, timeout time.Duration) error {
+	log.Infof("Waiting for Kamatera %s to complete", operation)
+	log.Infof("track progress in Kamatera console, command id = %d", commandId)
+	deadline := time.Now().Add(timeout)
+	for {
+		if timeout > 0 && time.Now().After(deadline) {
+			return errors.Errorf("Timed out waiting for Kamatera %s to complete (command id = %d)", operation, commandId)
+		}
+		log.Debugf("Waiting for %s (%s)", operation, time.Now())
+		time.Sleep(2000 * time.Millisecond)
+		resp, err := d.apiCall(fmt.Sprintf("command info (%d)", commandId), func(req *resty.Request) (*resty.Response, error) {
+			return req.SetResult(KamateraPowerOperationInfo{}).
+				Get(fmt.Sprintf("https://console.kamatera.com/service/queue/%d", commandId))
+		})
+		if err == errKamateraNotFound {
+			log.Infof("Waiting for command to start...")
+			continue
+		}
+		if err != nil {return err}
+		res := resp.Result().(*KamateraPowerOperationInfo)
+		log.Debugf("%s", res.Status)
+		if res.Status == "complete" {
+			log.Infof("Kamatera %s completed successfully", operation)
+			return nil
+		}
+		if res.Status == "error" {return errors.Errorf("Kamatera %s failed", operation)}
+		if res.Status == "cancelled" {return errors.Errorf("Kamatera %s cancelled", operation)}
+	}
+}
+
+// getServerOptions returns the available Kamatera server options
+func (d *Driver) getServerOptions() (*KamateraServerOptions, error) {
+	resp, err := d.apiCall("server options", func(req *resty.Request) (*resty.Response, error) {
+		return req.SetResult(KamateraServerOptions{}).Get("https://console.kamatera.com/service/server")
+	})
+	if err != nil {return nil, err}
+	return resp.Result().(*KamateraServerOptions), nil
+}
+
+// serverOperation runs an asynchronous operation on the Kamatera server and waits for its queue commands to complete
+func (d *Driver) serverOperation(operation string, method string, path string, formData map[string]string) error {
+	serverId, err := d.getKamateraServerId()
+	if err != nil {return errors.Wrap(err, "Failed to get server id")}
+	resp, err := d.apiCall(operation, func(req *resty.Request) (*resty.Response, error) {
+		if formData != nil {req.SetFormData(formData)}
+		return req.Execute(method, fmt.Sprintf("https://console.kamatera.com/service/server/%s/%s", serverId, path))
+	})
+	if err != nil {return err}
+	commandIds, err := parseCommandIds(resp.Body())
+	if err != nil {return err}
+	for _, commandId := range commandIds {
+		if err := d.waitForCommand(operation, commandId); err != nil {return err}
+	}
+	return nil
+}
+
+// listServers returns the servers in the Kamatera account
+func (d *Driver) listServers() ([]KamateraServerListInfo, error) {
+	resp, err := d.apiCall("servers list", func(req *resty.Request) (*resty.Response, error) {
+		return req.Get("https://console.kamatera.com/service/servers")
+	})
+	if err != nil {return nil, err}
+	var servers []KamateraServerListInfo
+	if err := json.Unmarshal(resp.Body(), &servers); err != nil {
+		return nil, errors.Wrap(err, "Invalid JSON response from Kamatera servers list")
+	}
+	return servers, nil
+}
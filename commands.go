@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// Command is a driver subcommand which operates on machines in the docker-machine store,
+// invoked directly: docker-machine-driver-kamatera COMMAND [OPTIONS] MACHINE_NAME
+type Command struct {
+	Name string
+	Usage string
+	Description string
+	Flags func(flags *flag.FlagSet)
+	Run func(flags *flag.FlagSet, args []string) error
+}
+
+var storagePath string
+
+// stringSliceFlag is a flag which can be provided multiple times
+type stringSliceFlag []string
+
+func (f *stringSliceFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringSliceFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func commands() []Command {
+	return []Command{
+		{
+			Name: "encrypt-config",
+			Usage: "[OPTIONS] MACHINE_NAME",
+			Description: "encrypt (or decrypt) the secrets in an existing machine config",
+			Flags: encryptConfigFlags,
+			Run: runEncryptConfig,
+		},
+		{
+			Name: "resize",
+			Usage: "[OPTIONS] MACHINE_NAME",
+			Description: "change the CPU / RAM or grow the disks of an existing machine",
+			Flags: resizeFlags,
+			Run: runResize,
+		},
+		{
+			Name: "attach-disk",
+			Usage: "--size SIZE MACHINE_NAME",
+			Description: "attach a new extra disk to an existing machine",
+			Flags: attachDiskFlags,
+			Run: runAttachDisk,
+		},
+		{
+			Name: "detach-disk",
+			Usage: "--disk DISK MACHINE_NAME",
+			Description: "detach and delete an extra disk of an existing machine",
+			Flags: detachDiskFlags,
+			Run: runDetachDisk,
+		},
+		{
+			Name: "snapshot-create",
+			Usage: "--name NAME MACHINE_NAME",
+			Description: "create a snapshot of a machine",
+			Flags: snapshotCreateFlags,
+			Run: runSnapshotCreate,
+		},
+		{
+			Name: "snapshot-list",
+			Usage: "MACHINE_NAME",
+			Description: "list the snapshots of a machine",
+			Run: runSnapshotList,
+		},
+		{
+			Name: "snapshot-revert",
+			Usage: "--snapshot NAME_OR_ID MACHINE_NAME",
+			Description: "revert a machine to a snapshot",
+			Flags: snapshotFlags,
+			Run: runSnapshotRevert,
+		},
+		{
+			Name: "snapshot-delete",
+			Usage: "--snapshot NAME_OR_ID MACHINE_NAME",
+			Description: "delete a snapshot of a machine",
+			Flags: snapshotFlags,
+			Run: runSnapshotDelete,
+		},
+		{
+			Name: "info",
+			Usage: "[--format json|table] MACHINE_NAME",
+			Description: "show the machine config and the live server details, secrets are omitted",
+			Flags: infoFlags,
+			Run: runInfo,
+		},
+		{
+			Name: "tag",
+			Usage: "[--add TAG]... [--remove TAG]... MACHINE_NAME",
+			Description: "add or remove tags of an existing machine and print its tags",
+			Flags: tagFlags,
+			Run: runTag,
+		},
+		{
+			Name: "find-servers",
+			Usage: "--tag TAG",
+			Description: "list the Kamatera servers which have a tag (e.g. docker-machine:MACHINE_NAME)",
+			Flags: findServersFlags,
+			Run: runFindServers,
+		},
+		{
+			Name: "gc",
+			Usage: "[--name-prefix PREFIX] [--dry-run=false [--yes]]",
+			Description: "find (and terminate) Kamatera servers created by the driver which have no docker-machine store entry",
+			Flags: gcFlags,
+			Run: runGC,
+		},
+	}
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: docker-machine-driver-kamatera COMMAND [OPTIONS] MACHINE_NAME\n\nCommands:\n")
+	for _, command := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", command.Name, command.Description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'docker-machine-driver-kamatera COMMAND -h' for command options\n")
+}
+
+// RunCommand runs the subcommand given in args
+func RunCommand(args []string) error {
+	for _, command := range commands() {
+		if command.Name != args[0] {continue}
+		flags := flag.NewFlagSet(command.Name, flag.ExitOnError)
+		flags.StringVar(&storagePath, "storage-path", defaultStoragePath(), "docker-machine storage path")
+		if command.Flags != nil {command.Flags(flags)}
+		flags.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: docker-machine-driver-kamatera %s %s\n\n%s\n\nOptions:\n", command.Name, command.Usage, command.Description)
+			flags.PrintDefaults()
+		}
+		flags.Parse(args[1:])
+		return command.Run(flags, flags.Args())
+	}
+	printUsage()
+	return errors.Errorf("Unknown command: %s", args[0])
+}
+
+// loadMachineArg loads the machine given as the single positional argument
+func loadMachineArg(flags *flag.FlagSet, args []string) (*Machine, error) {
+	if len(args) != 1 {
+		flags.Usage()
+		return nil, errors.New("Expected a single machine name argument")
+	}
+	return LoadMachine(storagePath, args[0])
+}
+
+// accountDriver returns a driver for account level commands, which are not related to a machine,
+// the API credentials are taken from the same environment variables as the create options
+func accountDriver() *Driver {
+	d := NewDriver()
+	d.APIClientID = os.Getenv("KAMATERA_API_CLIENT_ID")
+	d.APISecret = os.Getenv("KAMATERA_API_SECRET")
+	d.CredentialsFile = os.Getenv("KAMATERA_CREDENTIALS_FILE")
+	d.Profile = os.Getenv("KAMATERA_PROFILE")
+	d.CredentialHelper = os.Getenv("KAMATERA_CREDENTIAL_HELPER")
+	return d
+}
+
+var encryptConfigOptions struct {
+	keyFile string
+	ageRecipient string
+	ageIdentityFile string
+	decrypt bool
+}
+
+func encryptConfigFlags(flags *flag.FlagSet) {
+	flags.StringVar(&encryptConfigOptions.keyFile, "key-file", "", "path to a file containing the encryption passphrase (default: use "+envConfigEncryptionKey+")")
+	flags.StringVar(&encryptConfigOptions.ageRecipient, "age-recipient", "", "age recipient to encrypt to")
+	flags.StringVar(&encryptConfigOptions.ageIdentityFile, "age-identity-file", "", "age identity file to decrypt with (default: use "+envConfigAgeIdentityFile+")")
+	flags.BoolVar(&encryptConfigOptions.decrypt, "decrypt", false, "store the secrets unencrypted")
+}
+
+func runEncryptConfig(flags *flag.FlagSet, args []string) error {
+	m, err := loadMachineArg(flags, args)
+	if err != nil {return err}
+	if encryptConfigOptions.decrypt {
+		m.Driver.ConfigEncryption = ""
+	} else {
+		if err := m.Driver.setConfigEncryption(encryptConfigOptions.keyFile, encryptConfigOptions.ageRecipient, encryptConfigOptions.ageIdentityFile); err != nil {
+			return err
+		}
+		if m.Driver.ConfigEncryption == "" {
+			return errors.Errorf("Set %s, --key-file or --age-recipient to encrypt the machine config", envConfigEncryptionKey)
+		}
+	}
+	if err := m.Save(); err != nil {return err}
+	if m.Driver.ConfigEncryption == "" {
+		fmt.Printf("Machine %s config secrets are stored unencrypted\n", m.Name)
+	} else {
+		fmt.Printf("Machine %s config secrets are encrypted (%s)\n", m.Name, m.Driver.ConfigEncryption)
+	}
+	return nil
+}
+
+var resizeOptions struct {
+	cpu string
+	ram int
+	diskSizes string
+	growFilesystem bool
+}
+
+func resizeFlags(flags *flag.FlagSet) {
+	flags.StringVar(&resizeOptions.cpu, "cpu", "", "new CPU type and number of CPU cores (e.g. 2B)")
+	flags.IntVar(&resizeOptions.ram, "ram", 0, "new RAM size in MB")
+	flags.StringVar(&resizeOptions.diskSizes, "disk-sizes", "", "new disk sizes in GB (comma-separated INDEX=SIZE, 0 is the primary disk, e.g. 0=50,1=100)")
+	flags.BoolVar(&resizeOptions.growFilesystem, "grow-filesystem", false, "grow the filesystems on the resized disks over SSH")
+}
+
+func runResize(flags *flag.FlagSet, args []string) error {
+	m, err := loadMachineArg(flags, args)
+	if err != nil {return err}
+	diskSizes, err := ParseDiskSizes(resizeOptions.diskSizes)
+	if err != nil {return err}
+	err = saveAfter(m, func() error {
+		return m.Driver.Resize(ResizeOptions{
+			Cpu: resizeOptions.cpu,
+			Ram: resizeOptions.ram,
+			DiskSizes: diskSizes,
+			GrowFilesystem: resizeOptions.growFilesystem,
+		})
+	})
+	if err != nil {return err}
+	fmt.Printf("Machine %s: CPU %s, RAM %dMB, disk %dGB, extra disks %v\n", m.Name, m.Driver.Cpu, m.Driver.Ram, m.Driver.DiskSize, m.Driver.ExtraDiskSizesInt)
+	return nil
+}
+
+var diskOptions struct {
+	size int
+	disk int
+}
+
+func attachDiskFlags(flags *flag.FlagSet) {
+	flags.IntVar(&diskOptions.size, "size", 0, "disk size in GB")
+}
+
+func detachDiskFlags(flags *flag.FlagSet) {
+	flags.IntVar(&diskOptions.disk, "disk", 0, "extra disk number to detach (starting from 1), the disk and its data are deleted")
+}
+
+// saveAfter saves the machine config after running op, changes which were applied
+// before a failure are saved as well
+func saveAfter(m *Machine, op func() error) error {
+	err := op()
+	if saveErr := m.Save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+func runAttachDisk(flags *flag.FlagSet, args []string) error {
+	m, err := loadMachineArg(flags, args)
+	if err != nil {return err}
+	if diskOptions.size <= 0 {
+		flags.Usage()
+		return errors.New("--size is required")
+	}
+	if err := saveAfter(m, func() error { return m.Driver.AttachDisk(diskOptions.size) }); err != nil {return err}
+	fmt.Printf("Machine %s: extra disks %v\n", m.Name, m.Driver.ExtraDiskSizesInt)
+	return nil
+}
+
+func runDetachDisk(flags *flag.FlagSet, args []string) error {
+	m, err := loadMachineArg(flags, args)
+	if err != nil {return err}
+	if diskOptions.disk <= 0 {
+		flags.Usage()
+		return errors.New("--disk is required")
+	}
+	if err := saveAfter(m, func() error { return m.Driver.DetachDisk(diskOptions.disk) }); err != nil {return err}
+	fmt.Printf("Machine %s: extra disks %v\n", m.Name, m.Driver.ExtraDiskSizesInt)
+	return nil
+}
+
+var snapshotOptions struct {
+	name string
+	snapshot string
+}
+
+func snapshotCreateFlags(flags *flag.FlagSet) {
+	flags.StringVar(&snapshotOptions.name, "name", "", "snapshot name")
+}
+
+func snapshotFlags(flags *flag.FlagSet) {
+	flags.StringVar(&snapshotOptions.snapshot, "snapshot", "", "snapshot name or ID")
+}
+
+func runSnapshotCreate(flags *flag.FlagSet, args []string) error {
+	m, err := loadMachineArg(flags, args)
+	if err != nil {return err}
+	if snapshotOptions.name == "" {
+		flags.Usage()
+		return errors.New("--name is required")
+	}
+	return m.Driver.CreateSnapshot(snapshotOptions.name)
+}
+
+func runSnapshotList(flags *flag.FlagSet, args []string) error {
+	m, err := loadMachineArg(flags, args)
+	if err != nil {return err}
+	snapshots, err := m.Driver.ListSnapshots()
+	if err != nil {return err}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tDATE\tCURRENT")
+	for _, snapshot := range snapshots {
+		current := ""
+		if snapshot.Current {current = "*"}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", snapshot.id(), snapshot.Name, snapshot.Date, current)
+	}
+	return w.Flush()
+}
+
+func runSnapshotRevert(flags *flag.FlagSet, args []string) error {
+	m, err := loadMachineArg(flags, args)
+	if err != nil {return err}
+	if snapshotOptions.snapshot == "" {
+		flags.Usage()
+		return errors.New("--snapshot is required")
+	}
+	return m.Driver.RevertSnapshot(snapshotOptions.snapshot)
+}
+
+func runSnapshotDelete(flags *flag.FlagSet, args []string) error {
+	m, err := loadMachineArg(flags, args)
+	if err != nil {return err}
+	if snapshotOptions.snapshot == "" {
+		flags.Usage()
+		return errors.New("--snapshot is required")
+	}
+	return m.Driver.DeleteSnapshot(snapshotOptions.snapshot)
+}
+
+var infoOptions struct {
+	format string
+}
+
+func infoFlags(flags *flag.FlagSet) {
+	flags.StringVar(&infoOptions.format, "format", "json", "output format: json or table")
+}
+
+func runInfo(flags *flag.FlagSet, args []string) error {
+	m, err := loadMachineArg(flags, args)
+	if err != nil {return err}
+	info := m.Driver.Info()
+	switch infoOptions.format {
+	case "table":
+		return info.WriteTable(os.Stdout)
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(info)
+	default:
+		return errors.Errorf("Invalid format: %s", infoOptions.format)
+	}
+}
+
+var tagOptions struct {
+	add stringSliceFlag
+	remove stringSliceFlag
+	tag string
+}
+
+func tagFlags(flags *flag.FlagSet) {
+	flags.Var(&tagOptions.add, "add", "tag to add, can be provided multiple times")
+	flags.Var(&tagOptions.remove, "remove", "tag to remove, can be provided multiple times")
+}
+
+func runTag(flags *flag.FlagSet, args []string) error {
+	m, err := loadMachineArg(flags, args)
+	if err != nil {return err}
+	err = saveAfter(m, func() error {
+		for _, tag := range tagOptions.add {
+			if err := m.Driver.AddTag(tag); err != nil {return err}
+		}
+		for _, tag := range tagOptions.remove {
+			if err := m.Driver.RemoveTag(tag); err != nil {return err}
+		}
+		return nil
+	})
+	if err != nil {return err}
+	for _, tag := range m.Driver.Tags {
+		fmt.Println(tag)
+	}
+	return nil
+}
+
+func findServersFlags(flags *flag.FlagSet) {
+	flags.StringVar(&tagOptions.tag, "tag", managedByTag, "tag to find")
+}
+
+func runFindServers(flags *flag.FlagSet, args []string) error {
+	if len(args) != 0 {
+		flags.Usage()
+		return errors.New("Unexpected arguments")
+	}
+	servers, err := accountDriver().FindServersByTag(tagOptions.tag)
+	if err != nil {return err}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tDATACENTER\tPOWER\tTAGS")
+	for _, server := range servers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", server.Id, server.Name, server.Datacenter, server.Power, strings.Join(server.Tags, ","))
+	}
+	return w.Flush()
+}
+
+var gcOptions struct {
+	namePrefix string
+	dryRun bool
+	yes bool
+}
+
+func gcFlags(flags *flag.FlagSet) {
+	flags.StringVar(&gcOptions.namePrefix, "name-prefix", "", "also include servers whose name starts with this prefix (e.g. servers created before the managed-by tag was added)")
+	flags.BoolVar(&gcOptions.dryRun, "dry-run", true, "only list the orphan servers, set --dry-run=false to terminate them")
+	flags.BoolVar(&gcOptions.yes, "yes", false, "terminate without confirmation")
+}
+
+func runGC(flags *flag.FlagSet, args []string) error {
+	if len(args) != 0 {
+		flags.Usage()
+		return errors.New("Unexpected arguments")
+	}
+	d := accountDriver()
+	orphans, err := d.FindOrphanServers(storagePath, gcOptions.namePrefix)
+	if err != nil {return err}
+	if len(orphans) == 0 {
+		fmt.Println("No orphan servers found")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tDATACENTER\tPOWER\tAGE\tCOST")
+	for _, orphan := range orphans {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", orphan.Server.Id, orphan.Server.Name, orphan.Server.Datacenter, orphan.Server.Power, orphan.Age(), orphan.Cost())
+	}
+	if err := w.Flush(); err != nil {return err}
+	if gcOptions.dryRun {
+		fmt.Printf("%d orphan servers found, run with --dry-run=false to terminate them\n", len(orphans))
+		return nil
+	}
+	if ! gcOptions.yes {
+		fmt.Printf("Terminate %d servers? [y/N] ", len(orphans))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			return errors.New("Aborted")
+		}
+	}
+	numErrors := 0
+	for _, orphan := range orphans {
+		if err := d.TerminateOrphanServer(orphan); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to terminate server %s: %s\n", orphan.Server.Name, err)
+			numErrors++
+		}
+	}
+	if numErrors > 0 {
+		return errors.Errorf("Failed to terminate %d servers", numErrors)
+	}
+	fmt.Printf("Terminated %d servers\n", len(orphans))
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/pkg/errors"
+)
+
+const defaultProfile = "default"
+
+// KamateraCredentials are the Kamatera API credentials as returned by a credential helper
+type KamateraCredentials struct {
+	ClientID string `json:"clientId"`
+	Secret string `json:"secret"`
+}
+
+func defaultCredentialsFile() string {
+	return filepath.Join(mcnutils.GetHomeDir(), ".kamatera", "credentials")
+}
+
+// LoadCredentialsProfile reads a profile from a credentials file with the following format:
+//
+//   [default]
+//   client_id = ...
+//   secret = ...
+//
+//   [production]
+//   client_id = ...
+//   secret = ...
+func LoadCredentialsProfile(path string, profile string) (KamateraCredentials, error) {
+	var creds KamateraCredentials
+	file, err := os.Open(path)
+	if err != nil {
+		return creds, errors.Wrap(err, "Failed to open Kamatera credentials file")
+	}
+	defer file.Close()
+	found := false
+	currentProfile := ""
+	lineNumber := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNumber += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			currentProfile = strings.TrimSpace(line[1:len(line)-1])
+			if currentProfile == profile {found = true}
+			continue
+		}
+		if currentProfile != profile {continue}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return creds, errors.Errorf("Invalid line in Kamatera credentials file %s (line %d)", path, lineNumber)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "client_id":
+			creds.ClientID = value
+		case "secret":
+			creds.Secret = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return creds, errors.Wrap(err, "Failed to read Kamatera credentials file")
+	}
+	if ! found {
+		return creds, errors.Errorf("Profile '%s' not found in Kamatera credentials file %s", profile, path)
+	}
+	return creds, nil
+}
+
+// RunCredentialHelper runs the credential helper command and parses the JSON credentials it outputs
+func RunCredentialHelper(command string) (KamateraCredentials, error) {
+	var creds KamateraCredentials
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return creds, errors.Wrapf(err, "Kamatera credential helper failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return creds, errors.Wrap(err, "Invalid JSON output from Kamatera credential helper")
+	}
+	return creds, nil
+}
+
+// apiCredentials returns the Kamatera API client ID and secret, when not set directly they are
+// loaded from the credential helper or credentials file profile, which are not persisted
+func (d *Driver) apiCredentials() (string, string, error) {
+	if d.APIClientID != "" || d.APISecret != "" {
+		return d.APIClientID, d.APISecret, nil
+	}
+	if d.apiClientID != "" {
+		return d.apiClientID, d.apiSecret, nil
+	}
+	var creds KamateraCredentials
+	var err error
+	if d.CredentialHelper != "" {
+		log.Debugf("Getting Kamatera API credentials from credential helper")
+		creds, err = RunCredentialHelper(d.CredentialHelper)
+	} else {
+		if d.Profile == "" && d.CredentialsFile == "" {
+			if _, err := os.Stat(defaultCredentialsFile()); err != nil {
+				return "", "", errors.Errorf("kamatera requires --%v and --%v, --%v or --%v to be set",
+					flagAPIClientID, flagAPISecret, flagProfile, flagCredentialHelper)
+			}
+		}
+		if d.Profile == "" {d.Profile = defaultProfile}
+		if d.CredentialsFile == "" {d.CredentialsFile = defaultCredentialsFile()}
+		log.Debugf("Getting Kamatera API credentials from profile '%s' in %s", d.Profile, d.CredentialsFile)
+		creds, err = LoadCredentialsProfile(d.CredentialsFile, d.Profile)
+	}
+	if err != nil {return "", "", err}
+	if creds.ClientID == "" || creds.Secret == "" {
+		return "", "", errors.New("Kamatera API credentials are missing client ID or secret")
+	}
+	d.apiClientID, d.apiSecret = creds.ClientID, creds.Secret
+	return d.apiClientID, d.apiSecret, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// maximum number of disks per server, including the primary disk. The Kamatera server options
+// don't include a disk limit, so it's a constant
+const maxDisks = 4
+
+// unmounts the filesystem mounted on the given target and removes its fstab entry
+const unmountDiskScriptTemplate = `set -e
+target=%s
+if mountpoint -q "$target"; then umount "$target"; fi
+awk -v t="$target" '$2 != t' /etc/fstab > /etc/fstab.tmp && cat /etc/fstab.tmp > /etc/fstab && rm -f /etc/fstab.tmp
+`
+
+// updateExtraDisks updates the persisted extra disk sizes and mounts from the disk inventory
+func (d *Driver) updateExtraDisks() {
+	var sizes []string
+	for _, extraDiskSize := range d.ExtraDiskSizesInt {
+		sizes = append(sizes, strconv.Itoa(extraDiskSize))
+	}
+	d.ExtraDiskSizes = strings.Join(sizes, ",")
+	var mounts []string
+	for _, mount := range d.ExtraDiskMountsList {
+		mounts = append(mounts, fmt.Sprintf("%d=%s:%s", mount.Disk, mount.Target, mount.Filesystem))
+	}
+	d.ExtraDiskMounts = strings.Join(mounts, ",")
+}
+
+// AttachDisk adds a new extra disk to the Kamatera server
+func (d *Driver) AttachDisk(size int) error {
+	res, err := d.getServerOptions()
+	if err != nil {return err}
+	if ! IsIntInArray(size, res.Disk) {return errors.Errorf("Invalid disk size: %d", size)}
+	if len(d.ExtraDiskSizesInt) + 1 >= maxDisks {
+		return errors.Errorf("Too many disks: maximum allowed is %d extra disks", maxDisks - 1)
+	}
+	formData := map[string]string{"action": "add", "size": strconv.Itoa(size)}
+	if err := d.configureServer("disk add", "disk", formData); err != nil {return err}
+	d.ExtraDiskSizesInt = append(d.ExtraDiskSizesInt, size)
+	d.updateExtraDisks()
+	log.Infof("Attached extra disk %d (%dGB)", len(d.ExtraDiskSizesInt), size)
+	return nil
+}
+
+// DetachDisk detaches and deletes an extra disk (1-based) from the Kamatera server, if the disk was
+// mounted with --kamatera-extra-disk-mounts it's unmounted first. The following extra disks are
+// renumbered.
+func (d *Driver) DetachDisk(disk int) error {
+	if disk < 1 || disk > len(d.ExtraDiskSizesInt) {
+		return errors.Errorf("Invalid extra disk %d: the machine has %d extra disks", disk, len(d.ExtraDiskSizesInt))
+	}
+	if err := d.autoSnapshot("detach-disk"); err != nil {return err}
+	var mounts []ExtraDiskMount
+	for _, mount := range d.ExtraDiskMountsList {
+		if mount.Disk == disk {
+			if err := d.unmountDisk(mount); err != nil {return err}
+			continue
+		}
+		if mount.Disk > disk {mount.Disk--}
+		mounts = append(mounts, mount)
+	}
+	formData := map[string]string{"action": "remove", "index": strconv.Itoa(disk)}
+	if err := d.configureServer("disk remove", "disk", formData); err != nil {return err}
+	d.ExtraDiskSizesInt = append(d.ExtraDiskSizesInt[:disk - 1], d.ExtraDiskSizesInt[disk:]...)
+	d.ExtraDiskMountsList = mounts
+	d.updateExtraDisks()
+	log.Infof("Detached extra disk %d", disk)
+	return nil
+}
+
+func (d *Driver) unmountDisk(mount ExtraDiskMount) error {
+	log.Infof("Unmounting extra disk %d from %s", mount.Disk, mount.Target)
+	port, err := d.GetSSHPort()
+	if err != nil {return err}
+	client, err := d.waitForSSH(d.GetSSHUsername(), port)
+	if err != nil {return err}
+	defer client.Close()
+	script := fmt.Sprintf(unmountDiskScriptTemplate, mount.Target)
+	if _, err := runSSHCommandWithInput(client, sudoCmd(d.GetSSHUsername(), "sh -s"), script); err != nil {
+		return errors.Wrapf(err, "Failed to unmount extra disk %d from %s", mount.Disk, mount.Target)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+var extraDiskFilesystems = []string{"ext4", "xfs"}
+
+// matches mount targets which are safe to use in shell commands
+var mountTargetPattern = regexp.MustCompile(`^/[A-Za-z0-9_./-]*$`)
+
+// ExtraDiskMount mounts an extra disk (1-based, in --kamatera-extra-disk-sizes order) on Target
+type ExtraDiskMount struct {
+	Disk int
+	Target string
+	Filesystem string
+}
+
+// partitions, formats, adds an fstab entry and mounts an extra disk, each step is skipped if it was
+// already done so the script can be re-run. Disks are ordered by device name, the first is the OS disk.
+const extraDiskMountScriptTemplate = `set -e
+disk=%[1]d; target=%[2]s; fs=%[3]s
+dev=$(lsblk -dnpo NAME,TYPE | awk '$2=="disk"{print $1}' | sort | sed -n "$((disk + 1))p")
+[ -n "$dev" ] || { echo "extra disk $disk not found"; exit 1; }
+if lsblk -nro MOUNTPOINT "$dev" | grep -qx /; then echo "extra disk $disk ($dev) is the OS disk"; exit 1; fi
+part=$(lsblk -lnpo NAME,TYPE "$dev" | awk '$2=="part"{print $1}' | head -1)
+if [ -z "$part" ]; then
+  printf 'label: gpt\n,\n' | sfdisk -q "$dev"
+  udevadm settle 2>/dev/null || sleep 2
+  part=$(lsblk -lnpo NAME,TYPE "$dev" | awk '$2=="part"{print $1}' | head -1)
+  [ -n "$part" ] || { echo "failed to partition $dev"; exit 1; }
+fi
+if [ -z "$(blkid -o value -s TYPE "$part")" ]; then mkfs.$fs -q "$part"; fi
+uuid=$(blkid -o value -s UUID "$part")
+[ -n "$uuid" ] || { echo "failed to get filesystem UUID of $part"; exit 1; }
+mkdir -p "$target"
+grep -q "^UUID=$uuid " /etc/fstab || echo "UUID=$uuid $target $fs defaults,nofail 0 2" >> /etc/fstab
+mountpoint -q "$target" || mount "$target"
+`
+
+// ParseExtraDiskMounts parses the comma-separated DISK=TARGET[:FILESYSTEM] mounts
+func ParseExtraDiskMounts(value string) ([]ExtraDiskMount, error) {
+	var mounts []ExtraDiskMount
+	for _, mountStr := range strings.Split(value, ",") {
+		mountStr = strings.TrimSpace(mountStr)
+		if mountStr == "" {continue}
+		parts := strings.SplitN(mountStr, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid extra disk mount: '%s', expected DISK=TARGET[:FILESYSTEM]", mountStr)
+		}
+		disk, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || disk < 1 {
+			return nil, errors.Errorf("Invalid extra disk mount: '%s', disk must be the extra disk number starting from 1", mountStr)
+		}
+		mount := ExtraDiskMount{Disk: disk, Target: strings.TrimSpace(parts[1]), Filesystem: "ext4"}
+		if i := strings.LastIndex(mount.Target, ":"); i >= 0 {
+			mount.Filesystem = mount.Target[i + 1:]
+			mount.Target = mount.Target[:i]
+		}
+		if ! mountTargetPattern.MatchString(mount.Target) || path.Clean(mount.Target) == "/" {
+			return nil, errors.Errorf("Invalid extra disk mount target: '%s'", mount.Target)
+		}
+		mount.Target = path.Clean(mount.Target)
+		if ! IsStringInArray(mount.Filesystem, extraDiskFilesystems) {
+			return nil, errors.Errorf("Invalid extra disk filesystem: '%s', supported filesystems: %s", mount.Filesystem, strings.Join(extraDiskFilesystems, ", "))
+		}
+		for _, other := range mounts {
+			if other.Disk == mount.Disk {
+				return nil, errors.Errorf("Extra disk %d is mounted more than once", mount.Disk)
+			}
+			if other.Target == mount.Target {
+				return nil, errors.Errorf("Mount target %s is used for more than one extra disk", mount.Target)
+			}
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// validateExtraDiskMounts checks the mounted disks are created with --kamatera-extra-disk-sizes
+func (d *Driver) validateExtraDiskMounts() error {
+	for _, mount := range d.ExtraDiskMountsList {
+		if mount.Disk > len(d.ExtraDiskSizesInt) {
+			return errors.Errorf("Invalid extra disk mount: disk %d is not in --%s", mount.Disk, flagExtraDiskSizes)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) mountExtraDisks(client *ssh.Client) error {
+	for _, mount := range d.ExtraDiskMountsList {
+		log.Infof("Mounting extra disk %d on %s (%s)", mount.Disk, mount.Target, mount.Filesystem)
+		script := fmt.Sprintf(extraDiskMountScriptTemplate, mount.Disk, mount.Target, mount.Filesystem)
+		if _, err := runSSHCommandWithInput(client, "sh -s", script); err != nil {
+			return errors.Wrapf(err, "Failed to mount extra disk %d on %s", mount.Disk, mount.Target)
+		}
+	}
+	return nil
+}
@@ -8,20 +8,20 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnflag"
-	mcnssh "github.com/docker/machine/libmachine/ssh"
 	"github.com/docker/machine/libmachine/state"
-	"gopkg.in/resty.v1"
 	"github.com/pkg/errors"
 	"github.com/sethvargo/go-password/password"
-	"golang.org/x/crypto/ssh"
+	"gopkg.in/resty.v1"
 )
 
 type Driver struct {
@@ -29,8 +29,15 @@ type Driver struct {
 
 	APIClientID string
 	APISecret string
+	CredentialsFile string
+	Profile string
+	CredentialHelper string
+	apiClientID string
+	apiSecret string
 	Datacenter string
 	Billing string
+	Backup bool
+	Managed bool
 	Traffic string
 	TrafficDescription string
 	Cpu string
@@ -38,33 +45,62 @@ type Driver struct {
 	DiskSize int
 	ExtraDiskSizes string
 	ExtraDiskSizesInt []int
+	ExtraDiskMounts string
+	ExtraDiskMountsList []ExtraDiskMount
 	Image string
 	PrivateNetworkName string
 	PrivateNetworkIp string
 	PrivateNetworkIps []string
 	StartupScriptFile string
 	StartupScriptString string
-	ExtraSshKeyFile string
-	ExtraSshKeyString string
+	ExtraSshKeyFiles []string
+	ExtraSshKeyStrings []string
+	ExtraSshKeyUrls []string
 	UserDataFile string
 	UserDataString string
 	StartupScript string
-	ExtraSshKey string
+	ExtraSshKeys []string
+	SSHKeyName string
+	SelectedSSHKeyId string
+	UploadSSHKey bool
+	UploadedSSHKeyId string
 	UserData string
-	tags []string
+	Template bool
+	TemplateVars []string
+	SkipInitValidation bool
+	WaitForInit bool
+	Tags []string
+	// closed when Create is interrupted
+	interrupted chan struct{}
+	KeepOnFailure bool
+	DisableRootLogin bool
+	ExistingSSHKeyPath string
+	RedactScripts bool
+	AutoSnapshot bool
+	ProtectRunning bool
+	StopTimeout int
+	ConfigEncryption string
+	ConfigEncryptionKeyFile string
+	ConfigAgeRecipient string
+	ConfigAgeIdentityFile string
+	EncryptedFields string
 
 	ServerOptions map[string]interface{}
 	ImageID string
 	CreateServerCommandId int
 	DiskImageId string
 	DatacenterName string
-	Password string
 	KamateraServerId string
 	ServerName string
+	SSHHostKey string
 }
 
+// how long Remove waits for the server termination to complete
+const removeServerTimeout = 15 * time.Minute
+
 const (
 	defaultDatacenter = "EU"
+	defaultStopTimeout = 120
 	defaultBilling = "hourly"
 	defaultCpu  = "1B"
 	defaultRam = 1024
@@ -73,13 +109,19 @@ const (
 
 	flagAPIClientID = "kamatera-api-client-id"
 	flagAPISecret = "kamatera-api-secret"
+	flagCredentialsFile = "kamatera-credentials-file"
+	flagProfile = "kamatera-profile"
+	flagCredentialHelper = "kamatera-credential-helper"
 	flagDatacenter = "kamatera-datacenter"
 	flagBilling = "kamatera-billing"
+	flagBackup = "kamatera-backup"
+	flagManaged = "kamatera-managed"
 	flagTraffic = "kamatera-traffic"
 	flagCpu = "kamatera-cpu"
 	flagRam = "kamatera-ram"
 	flagDiskSize = "kamatera-disk-size"
 	flagExtraDiskSizes = "kamatera-extra-disk-sizes"
+	flagExtraDiskMounts = "kamatera-extra-disk-mounts"
 	flagImage = "kamatera-image"
 	flagCreateServerCommandId = "kamatera-create-server-command-id"
 	flagPrivateNetworkName = "kamatera-private-network-name"
@@ -88,9 +130,30 @@ const (
 	flagScriptString = "kamatera-script"
 	flagExtraSshKeyFile = "kamatera-extra-sshkey-file"
 	flagExtraSshKeyString = "kamatera-extra-sshkey"
+	flagExtraSshKeyUrl = "kamatera-extra-sshkey-url"
+	flagSSHKeyName = "kamatera-ssh-key-name"
+	flagUploadSSHKey = "kamatera-upload-ssh-key"
 	flagUserDataFile = "kamatera-userdata-file"
 	flagUserDataString = "kamatera-userdata"
 	flagTag = "kamatera-tag"
+	flagTemplate = "kamatera-template"
+	flagTemplateVar = "kamatera-template-var"
+	flagSkipInitValidation = "kamatera-skip-init-validation"
+	flagWaitForInit = "kamatera-wait-for-init"
+	flagKeepOnFailure = "kamatera-keep-on-failure"
+	flagSSHUser = "kamatera-ssh-user"
+	flagDisableRootLogin = "kamatera-disable-root-login"
+	flagSSHPort = "kamatera-ssh-port"
+	flagSSHKeyPath = "kamatera-ssh-key-path"
+	flagRedactScripts = "kamatera-redact-scripts"
+	flagAutoSnapshot = "kamatera-auto-snapshot"
+	flagProtectRunning = "kamatera-protect-running"
+	flagStopTimeout = "kamatera-stop-timeout"
+	// docker-machine rm doesn't pass driver flags, force is set using an environment variable
+	envForce = "KAMATERA_FORCE"
+	flagConfigEncryptionKeyFile = "kamatera-config-encryption-key-file"
+	flagConfigAgeRecipient = "kamatera-config-age-recipient"
+	flagConfigAgeIdentityFile = "kamatera-config-age-identity-file"
 )
 
 func NewDriver() *Driver {
@@ -108,9 +171,10 @@ func NewDriver() *Driver {
 		KamateraServerId: "",
 		PrivateNetworkName: "",
 		PrivateNetworkIp: "",
+		StopTimeout: defaultStopTimeout,
 		BaseDriver: &drivers.BaseDriver{
 			SSHUser: "root",
-			SSHPort: 22,
+			SSHPort: defaultSSHPort,
 			// IPAddress      string
 			// MachineName    string
 			// SSHUser        string
@@ -142,10 +206,28 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "Kamatera API secret",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_CREDENTIALS_FILE",
+			Name:   flagCredentialsFile,
+			Usage:  "path to Kamatera credentials file (default: ~/.kamatera/credentials)",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_PROFILE",
+			Name:   flagProfile,
+			Usage:  "Kamatera credentials file profile",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_CREDENTIAL_HELPER",
+			Name:   flagCredentialHelper,
+			Usage:  "command which outputs Kamatera API credentials as JSON: {\"clientId\": \"...\", \"secret\": \"...\"}",
+			Value:  "",
+		},
 		mcnflag.IntFlag{
 			EnvVar: "KAMATERA_CREATE_SERVER_COMMAND_ID",
 			Name:   flagCreateServerCommandId,
-			Usage:  "Kamatera Create Server Command Id",
+			Usage:  "Kamatera Create Server Command Id, resume a previously started create server command (requires --kamatera-ssh-key-path)",
 			Value:  0,
 		},
 		mcnflag.StringFlag{
@@ -160,6 +242,16 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "Kamatera billing method",
 			Value:  defaultBilling,
 		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_BACKUP",
+			Name:   flagBackup,
+			Usage:  "enable Kamatera daily backups, billed as an additional service (optional)",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_MANAGED",
+			Name:   flagManaged,
+			Usage:  "enable Kamatera managed services, billed as an additional service (optional)",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "KAMATERA_TRAFFIC",
 			Name:   flagTraffic,
@@ -190,6 +282,12 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "Kamatera extra disk sizes (in GB, comma-separated)",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_EXTRA_DISK_MOUNTS",
+			Name:   flagExtraDiskMounts,
+			Usage:  "format and mount extra disks (comma-separated DISK=TARGET[:FILESYSTEM], e.g. 1=/var/lib/docker:ext4,2=/data:xfs)",
+			Value:  "",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "KAMATERA_IMAGE",
 			Name:   flagImage,
@@ -220,18 +318,35 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "startup script (optional)",
 			Value:  "",
 		},
-		mcnflag.StringFlag{
+		mcnflag.StringSliceFlag{
 			EnvVar: "KAMATERA_EXTRA_SSHKEY_FILE",
 			Name:   flagExtraSshKeyFile,
-			Usage:  "path to public SSH key file to add to authorized keys (optional)",
-			Value:  "",
+			Usage:  "path to public SSH keys file (authorized_keys format) to add to authorized keys, can be provided multiple times (optional)",
+			Value:  []string{},
 		},
-		mcnflag.StringFlag{
+		mcnflag.StringSliceFlag{
 			EnvVar: "KAMATERA_EXTRA_SSHKEY",
 			Name:   flagExtraSshKeyString,
-			Usage:  "public SSH key to add to authorized keys (optional)",
+			Usage:  "public SSH key to add to authorized keys, can be provided multiple times (optional)",
+			Value:  []string{},
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "KAMATERA_EXTRA_SSHKEY_URL",
+			Name:   flagExtraSshKeyUrl,
+			Usage:  "gh:<username> or https URL to fetch public SSH keys from on creation, can be provided multiple times (optional)",
+			Value:  []string{},
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_SSH_KEY_NAME",
+			Name:   flagSSHKeyName,
+			Usage:  "name of an SSH key stored in the Kamatera account to add to the server (optional)",
 			Value:  "",
 		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_UPLOAD_SSH_KEY",
+			Name:   flagUploadSSHKey,
+			Usage:  "store the machine SSH public key in the Kamatera account, it's deleted when the machine is removed (optional)",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "KAMATERA_USER_DATA_FILE",
 			Name:   flagUserDataFile,
@@ -246,91 +361,235 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		},
 		mcnflag.StringSliceFlag{
 			Name: flagTag,
-			Usage: "Server tags (example: --kamatera-tag db --kamatera-tag production)",
+			Usage: "Server tags, docker-machine:MACHINE_NAME and managed-by:docker-machine-driver-kamatera tags are added automatically (example: --kamatera-tag db --kamatera-tag production)",
+			Value: []string{},
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_TEMPLATE",
+			Name:   flagTemplate,
+			Usage:  "render the startup script and user-data as Go templates with the machine metadata (optional)",
+		},
+		mcnflag.StringSliceFlag{
+			Name: flagTemplateVar,
+			Usage: "template variable, can be provided multiple times (example: --kamatera-template-var env=production)",
 			Value: []string{},
 		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_SKIP_INIT_VALIDATION",
+			Name:   flagSkipInitValidation,
+			Usage:  "skip validation of the startup script and user-data contents, size limits are still enforced (optional)",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_WAIT_FOR_INIT",
+			Name:   flagWaitForInit,
+			Usage:  "wait for the startup script and cloud-init to complete, creation fails if they fail (optional)",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_KEEP_ON_FAILURE",
+			Name:   flagKeepOnFailure,
+			Usage:  "keep the Kamatera server if machine creation fails or is interrupted after the server was created (optional)",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_SSH_USER",
+			Name:   flagSSHUser,
+			Usage:  "SSH user, if not root a sudo-enabled user is created on initialization (optional)",
+			Value:  "root",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_DISABLE_ROOT_LOGIN",
+			Name:   flagDisableRootLogin,
+			Usage:  "disable SSH root login, requires a non-root --kamatera-ssh-user (optional)",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "KAMATERA_SSH_PORT",
+			Name:   flagSSHPort,
+			Usage:  "SSH port, sshd is reconfigured on initialization if not 22 (optional)",
+			Value:  defaultSSHPort,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_SSH_KEY_PATH",
+			Name:   flagSSHKeyPath,
+			Usage:  "path to an existing private SSH key to use instead of generating a new key (optional)",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_REDACT_SCRIPTS",
+			Name:   flagRedactScripts,
+			Usage:  "mask startup script and user-data contents in debug logs (optional)",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_AUTO_SNAPSHOT",
+			Name:   flagAutoSnapshot,
+			Usage:  "create a snapshot of the server before resize and detach-disk operations (optional)",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "KAMATERA_PROTECT_RUNNING",
+			Name:   flagProtectRunning,
+			Usage:  "refuse to remove the machine while the server is running unless " + envForce + "=1 is set (optional)",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "KAMATERA_STOP_TIMEOUT",
+			Name:   flagStopTimeout,
+			Usage:  "seconds to wait for a graceful shutdown on stop before powering off, 0 powers off immediately",
+			Value:  defaultStopTimeout,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_CONFIG_ENCRYPTION_KEY_FILE",
+			Name:   flagConfigEncryptionKeyFile,
+			Usage:  "path to a file containing the passphrase used to encrypt secrets in the machine config (optional)",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KAMATERA_CONFIG_AGE_RECIPIENT",
+			Name:   flagConfigAgeRecipient,
+			Usage:  "age recipient used to encrypt secrets in the machine config, requires the age binary (optional)",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: envConfigAgeIdentityFile,
+			Name:   flagConfigAgeIdentityFile,
+			Usage:  "age identity file used to decrypt secrets in the machine config (optional)",
+			Value:  "",
+		},
 	}
 }
 
 func (d *Driver) SetConfigFromFlags(opts drivers.DriverOptions) error {
 	d.APIClientID = opts.String(flagAPIClientID)
 	d.APISecret = opts.String(flagAPISecret)
+	d.CredentialsFile = opts.String(flagCredentialsFile)
+	d.Profile = opts.String(flagProfile)
+	d.CredentialHelper = opts.String(flagCredentialHelper)
 	d.Datacenter = opts.String(flagDatacenter)
 	d.Billing = opts.String(flagBilling)
+	d.Backup = opts.Bool(flagBackup)
+	d.Managed = opts.Bool(flagManaged)
 	d.Traffic = opts.String(flagTraffic)
 	d.Cpu = opts.String(flagCpu)
 	d.Ram = opts.Int(flagRam)
 	d.DiskSize = opts.Int(flagDiskSize)
 	d.ExtraDiskSizes = opts.String(flagExtraDiskSizes)
+	d.ExtraDiskMounts = opts.String(flagExtraDiskMounts)
+	var err error
+	if d.ExtraDiskMountsList, err = ParseExtraDiskMounts(d.ExtraDiskMounts); err != nil {
+		return err
+	}
 	d.Image = opts.String(flagImage)
 	d.CreateServerCommandId = opts.Int(flagCreateServerCommandId)
 	d.PrivateNetworkName = opts.String(flagPrivateNetworkName)
 	d.PrivateNetworkIp = opts.String(flagPrivateNetworkIp)
 	d.StartupScriptFile = opts.String(flagScriptFile)
 	d.StartupScriptString = opts.String(flagScriptString)
-	d.ExtraSshKeyFile = opts.String(flagExtraSshKeyFile)
-	d.ExtraSshKeyString = opts.String(flagExtraSshKeyString)
+	d.ExtraSshKeyFiles = opts.StringSlice(flagExtraSshKeyFile)
+	d.ExtraSshKeyStrings = opts.StringSlice(flagExtraSshKeyString)
+	d.ExtraSshKeyUrls = opts.StringSlice(flagExtraSshKeyUrl)
+	d.SSHKeyName = opts.String(flagSSHKeyName)
+	d.UploadSSHKey = opts.Bool(flagUploadSSHKey)
 	d.UserDataFile = opts.String(flagUserDataFile)
 	d.UserDataString = opts.String(flagUserDataString)
-	d.tags = opts.StringSlice(flagTag)
+	d.Tags = d.withAutomaticTags(opts.StringSlice(flagTag))
+	d.Template = opts.Bool(flagTemplate)
+	d.TemplateVars = opts.StringSlice(flagTemplateVar)
+	d.SkipInitValidation = opts.Bool(flagSkipInitValidation)
+	d.WaitForInit = opts.Bool(flagWaitForInit)
+	d.KeepOnFailure = opts.Bool(flagKeepOnFailure)
+	d.SSHUser = opts.String(flagSSHUser)
+	d.DisableRootLogin = opts.Bool(flagDisableRootLogin)
+	d.SSHPort = opts.Int(flagSSHPort)
+	d.ExistingSSHKeyPath = opts.String(flagSSHKeyPath)
+	if d.CreateServerCommandId != 0 && d.ExistingSSHKeyPath == "" {
+		// the server only accepts the SSH key it was created with
+		return errors.Errorf("--%s requires --%s with the SSH key the server was created with", flagCreateServerCommandId, flagSSHKeyPath)
+	}
+	d.RedactScripts = opts.Bool(flagRedactScripts)
+	d.AutoSnapshot = opts.Bool(flagAutoSnapshot)
+	d.ProtectRunning = opts.Bool(flagProtectRunning)
+	d.StopTimeout = opts.Int(flagStopTimeout)
+	if err := d.setConfigEncryption(opts.String(flagConfigEncryptionKeyFile), opts.String(flagConfigAgeRecipient), opts.String(flagConfigAgeIdentityFile)); err != nil {
+		return err
+	}
 
 	d.SetSwarmConfigFromFlags(opts)
 
-	if d.APIClientID == "" {
-		return errors.Errorf("kamatera requires --%v to be set", flagAPIClientID)
+	if d.APIClientID != "" || d.APISecret != "" {
+		if d.APIClientID == "" {
+			return errors.Errorf("kamatera requires --%v to be set", flagAPIClientID)
+		}
+		if d.APISecret == "" {
+			return errors.Errorf("kamatera requires --%v to be set", flagAPISecret)
+		}
+	} else if _, _, err := d.apiCredentials(); err != nil {
+		return err
+	}
+
+	if ! sshUserPattern.MatchString(d.SSHUser) {
+		return errors.Errorf("Invalid --%v: %s", flagSSHUser, d.SSHUser)
+	}
+
+	if d.DisableRootLogin && d.SSHUser == "root" {
+		return errors.Errorf("--%v requires a non-root --%v", flagDisableRootLogin, flagSSHUser)
+	}
+
+	if d.SSHPort < 1 || d.SSHPort > 65535 {
+		return errors.Errorf("Invalid --%v: %d", flagSSHPort, d.SSHPort)
+	}
+
+	if _, err := d.templateVars(); err != nil {
+		return err
 	}
 
-	if d.APISecret == "" {
-		return errors.Errorf("kamatera requires --%v to be set", flagAPISecret)
+	if d.SSHKeyName != "" && d.UploadSSHKey {
+		return errors.Errorf("Can't use both --%v and --%v", flagSSHKeyName, flagUploadSSHKey)
 	}
 
 	return nil
 }
 
 type KamateraDiskImage struct {
-	Description string `json:description`
-	Id string `json:id`
-	SizeGB int `json:sizeGB`
+	Description string `json:"description"`
+	Id string `json:"id"`
+	SizeGB int `json:"sizeGB"`
 }
 
 type KamateraNetwork struct {
-	Name string `json:name`
-	Ips interface{} `json:ips`
+	Name string `json:"name"`
+	Ips interface{} `json:"ips"`
 }
 
 type KamateraTraffic struct {
-	Id interface{} `json:id`
-	Info string `json:info"`
+	Id interface{} `json:"id"`
+	Info string `json:"info"`
 }
 
 type KamateraServerOptions struct {
-	Datacenters map[string]string `json:datacenters`
-	Cpu []string `json:cpu`
+	Datacenters map[string]string `json:"datacenters"`
+	Cpu []string `json:"cpu"`
 	// RAM structure changed to include a level of CPU type, which is the suffix letter of the selected CPU string
 	// Ram []int `json:ram`
-	Disk []int `json:disk`
-	Billing []string `json:billing`
-	DiskImages map[string][]KamateraDiskImage `json:datacenters`
-	Networks map[string][]KamateraNetwork `json:networks`
-	Traffic map[string][]KamateraTraffic `json:traffic`
+	Disk []int `json:"disk"`
+	Billing []string `json:"billing"`
+	DiskImages map[string][]KamateraDiskImage `json:"diskImages"`
+	Networks map[string][]KamateraNetwork `json:"networks"`
+	Traffic map[string][]KamateraTraffic `json:"traffic"`
 }
 
 type KamateraServerCommandInfo struct {
-	Status string `json:status`
-	Server string `json:server`
-	Description string `json:description`
-	Log string `json:log`
+	Status string `json:"status"`
+	Server string `json:"server"`
+	Description string `json:"description"`
+	Log string `json:"log"`
 }
 
 type KamateraPowerOperationInfo struct {
-	Status string `json:status`
+	Status string `json:"status"`
 }
 
 type KamateraServerListInfo struct {
-	Id string `json:id`
-	Datacenter string `json:datacenter`
-	Name string `json:name`
-	Power string `json:power`
+	Id string `json:"id"`
+	Datacenter string `json:"datacenter"`
+	Name string `json:"name"`
+	Power string `json:"power"`
+	Tags []string `json:"tags"`
 }
 
 func IsStringInArray(str string, arr []string) bool {
@@ -372,20 +631,33 @@ func (d *Driver) PreCreateCheck() error {
 	if err, d.StartupScript = GetFileArgString("script-file", d.StartupScriptFile, d.StartupScriptString); err != nil {
 		return err
 	}
-	if err, d.ExtraSshKey = GetFileArgString("extra-sshkey", d.ExtraSshKeyFile, d.ExtraSshKeyString); err != nil {
+	if d.ExtraSshKeys, err = d.loadExtraSSHKeys(); err != nil {
 		return err
 	}
+	if d.SSHKeyName != "" {
+		if d.SelectedSSHKeyId, err = d.findAccountSSHKeyId(d.SSHKeyName); err != nil {
+			return err
+		}
+	}
 	if err, d.UserData = GetFileArgString("userdata", d.UserDataFile, d.UserDataString); err != nil {
 		return err
 	}
+	if d.ServerName == "" {
+		if err := d.generateServerName(); err != nil {return err}
+	}
+	if script, userData, err := d.renderTemplates(); err != nil {
+		return err
+	} else if err := d.validateInitInputs(script, userData); err != nil {
+		return err
+	}
 	i := 0
 	for {
 		log.Debugf("PreCreateCheck (%d): %s", i, time.Now())
 		if i > 0 {time.Sleep(time.Duration(i * 6000) * time.Millisecond)}
 		i += 1
-		resp, err := resty.R().
-			SetHeader("AuthClientId", d.APIClientID).
-			SetHeader("AuthSecret", d.APISecret).
+		req, err := d.apiRequest()
+		if err != nil {return err}
+		resp, err := req.
 			SetResult(KamateraServerOptions{}).
 			Get("https://console.kamatera.com/service/server")
 		if err != nil {return err}
@@ -394,9 +666,9 @@ func (d *Driver) PreCreateCheck() error {
 				return errors.New("Kamatera resource not found, please try again")
 			}
 			if resp.StatusCode() == 500 {
-				return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
+				return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", d.redact(resp.String())))
 			}
-			log.Info(resp.String())
+			log.Info(d.redact(resp.String()))
 			if i >= 10 {
 				return errors.New(fmt.Sprintf("Invalid status code: %d", resp.StatusCode()))
 			}
@@ -424,9 +696,10 @@ func (d *Driver) PreCreateCheck() error {
 				d.ExtraDiskSizesInt = append(d.ExtraDiskSizesInt, extraDiskSizeInt)
 			}
 		}
-		if len(d.ExtraDiskSizesInt) > 3 {
-			return errors.New("Too many extra disk sizes: maximum allowed is 3")
+		if len(d.ExtraDiskSizesInt) + 1 > maxDisks {
+			return errors.New(fmt.Sprintf("Too many extra disk sizes: maximum allowed is %d", maxDisks - 1))
 		}
+		if err := d.validateExtraDiskMounts(); err != nil {return err}
 		if ! IsStringInArray(d.Billing, res.Billing) {return errors.New("Invalid billing")}
 		diskImages := res.DiskImages[d.Datacenter]
 		for _, diskImage := range diskImages {
@@ -436,6 +709,7 @@ func (d *Driver) PreCreateCheck() error {
 			}
 		}
 		if d.DiskImageId == "" {return errors.New(fmt.Sprintf("Invalid disk image: %s", d.Image))}
+		if err := d.validateImageOS(); err != nil {return err}
 		if d.PrivateNetworkName != "" {
 			if d.PrivateNetworkIp == "" {
 				d.PrivateNetworkIp = "auto"
@@ -472,6 +746,13 @@ func (d *Driver) PreCreateCheck() error {
 	}
 }
 
+func (d *Driver) generateServerName() error {
+	serverNameSuffix, err := password.Generate(6, 0, 0, false, false)
+	if err != nil {return err}
+	d.ServerName = fmt.Sprintf("%s-%s", d.MachineName, serverNameSuffix)
+	return nil
+}
+
 func (d *Driver) GetPrivateNetworkIp() string {
 	if d.PrivateNetworkIp == "" {
 		return "auto"
@@ -485,6 +766,10 @@ type CreateServerPostTag struct {
 	Label string `json:"label"`
 }
 
+// generatePassword makes Kamatera generate a random root password on the server side,
+// the driver authenticates using the SSH key passed in SelectedSSHKeyValue instead
+const generatePassword = "__generate__"
+
 type CreateServerPostValues struct {
 	Datacenter string `json:"datacenter"`
 	NServers int64 `json:"nServers"`
@@ -522,7 +807,14 @@ type CreateServerPostValues struct {
 
 func (d *Driver) Create() error {
 	log.Debugf("Create: %s", time.Now())
-	if d.CreateServerCommandId == 0 {
+	resumed := d.CreateServerCommandId != 0
+	if resumed {
+		log.Infof("Resuming Kamatera create server command %d", d.CreateServerCommandId)
+		if _, err := d.prepareSSHKey(); err != nil {return err}
+		// PreCreateCheck is skipped when resuming, the extra keys are installed by initializeServer
+		var err error
+		if d.ExtraSshKeys, err = d.loadExtraSSHKeys(); err != nil {return err}
+	} else {
 		log.Infof("Creating Kamatera server...")
 		log.Infof("Datacenter: %s", d.DatacenterName)
 		log.Infof("Cpu: %s", d.Cpu)
@@ -538,6 +830,12 @@ func (d *Driver) Create() error {
 		} else {
 			billingMode = 1
 		}
+		if d.Backup {
+			log.Infof("Daily backups: enabled (additional cost, the price isn't available from the Kamatera API, see Kamatera pricing)")
+		}
+		if d.Managed {
+			log.Infof("Managed services: enabled (additional cost, the price isn't available from the Kamatera API, see Kamatera pricing)")
+		}
 		if d.PrivateNetworkName != "" {
 			log.Infof("Private network name: %s", d.PrivateNetworkName)
 			if d.PrivateNetworkIp != "" {
@@ -554,11 +852,11 @@ func (d *Driver) Create() error {
 		if d.UserData != "" {
 			log.Info("With user data")
 		}
-		if d.ExtraSshKey != "" {
-			log.Info("With extra SSH key")
+		if len(d.ExtraSshKeys) > 0 {
+			log.Infof("With %d extra SSH keys", len(d.ExtraSshKeys))
 		}
 		var tags []CreateServerPostTag
-		for _, tag := range d.tags {
+		for _, tag := range d.Tags {
 			tags = append(tags, CreateServerPostTag{
 				Value: tag,
 				Label: tag,
@@ -571,211 +869,349 @@ func (d *Driver) Create() error {
 		for _, diskSize := range d.ExtraDiskSizesInt {
 			diskSizesGB = append(diskSizesGB, diskSize)
 		}
-		password_, err := password.Generate(12, 3, 0, false, false)
+		clientID, secret, err := d.apiCredentials()
 		if err != nil {return err}
-		d.Password = password_
-		i := 0
-		for {
-			netModes := []string{"wan"}
-			netNames := []string{"auto"}
-			netSubnets := []string{""}
-			netPrefixes := []int{0}
-			netIps := []string{"auto"}
-			if d.PrivateNetworkName != "" {
-				privateNetworkIp := d.PrivateNetworkIp
-				if d.PrivateNetworkIp == "" {
-					privateNetworkIp = "auto"
-				}
-				netModes = append(netModes, "lan")
-				netNames = append(netNames, d.PrivateNetworkName)
-				netSubnets = append(netSubnets, "")
-				netPrefixes = append(netPrefixes, 0)
-				netIps = append(netIps, privateNetworkIp)
-			}
-			serverNameSuffix, err := password.Generate(6, 0, 0, false, false)
+		pkey, err := d.prepareSSHKey()
+		if err != nil {return err}
+		log.Debugf("Generating SSH host key...")
+		hostKeyPEM, err := d.generateSSHHostKey()
+		if err != nil {return err}
+		if d.UploadSSHKey && d.UploadedSSHKeyId == "" {
+			keyNameSuffix, err := password.Generate(6, 0, 0, false, false)
 			if err != nil {return err}
-			d.ServerName = fmt.Sprintf("%s-%s", d.MachineName, serverNameSuffix)
-			postValues := CreateServerPostValues{
-				Datacenter:          d.Datacenter,
-				NServers:            1,
-				Names:               []string{d.ServerName},
-				CpuStr:              d.Cpu,
-				CpuType:             d.Cpu[len(d.Cpu)-1:],
-				RamMB:               d.Ram,
-				DiskSizesGB:         diskSizesGB,
-				Password:            d.Password,
-				PasswordValidate:    d.Password,
-				Managed:             false,
-				Backup:              false,
-				BillingMode:         billingMode,
-				TrafficPackage:      d.Traffic,
-				UseSimpleNetworking: false,
-				PowerOnCompletion:   true,
-				UseSimpleWan:        false,
-				UseSimpleLan:        false,
-				NetModes:            netModes,
-				NetNames:            netNames,
-				NetSubnets:          netSubnets,
-				NetPrefixes:         netPrefixes,
-				NetIps:              netIps,
-				DiskImageId:         d.DiskImageId,
-				SourceServerId:      "",
-				UserId:              0,
-				OwnerId:             0,
-				SrcUI:               false,
-				SelectedKey:         "",
-				Script:              d.StartupScript,
-				SelectedSSHKeyValue: d.ExtraSshKey,
-				SelectedTags:        tags,
-				UserData:            d.UserData,
-			}
-			log.Debugf("POST https://console.kamatera.com/svc/serverCreate %v", postValues)
-			log.Debugf("Create (%d): %s", i, time.Now())
-			if i > 0 {
-				log.Debugf("Retry %d / 10", i)
-				time.Sleep(time.Duration(i * 6000) * time.Millisecond)
-			}
-			i += 1
-			buf := new(bytes.Buffer)
-			if e := json.NewEncoder(buf).Encode(postValues); e != nil {
-				return e
-			}
-			req, e := http.NewRequest("POST", "https://console.kamatera.com/svc/serverCreate", buf)
-			if e != nil {
-				return e
+			keyName := fmt.Sprintf("docker-machine-%s-%s", d.MachineName, keyNameSuffix)
+			log.Infof("Storing the machine SSH key in the Kamatera account: %s", keyName)
+			if d.UploadedSSHKeyId, err = d.uploadAccountSSHKey(keyName, pkey); err != nil {
+				return errors.Wrap(err, "Failed to store the machine SSH key in the Kamatera account")
 			}
-			req.Header.Add("User-Agent", "docker-machine-driver-kamatera/v0.0.0")
-			req.Header.Add("Host", "console.kamatera.com")
-			req.Header.Add("Accept", "application/json")
-			req.Header.Add("Content-Type", "application/json")
-			req.Header.Add("AuthClientId", d.APIClientID)
-			req.Header.Add("AuthSecret", d.APISecret)
-			r, err := http.DefaultClient.Do(req)
-			if err != nil {
-				if i >= 10 {
-					return errors.Wrap(err, "Unexpected error")
-				} else {
-					log.Debugf("Unexpected error: %s", err)
-					continue
+			d.SelectedSSHKeyId = d.UploadedSSHKeyId
+		}
+		postCreateServer := func() error {
+			i := 0
+			for {
+				netModes := []string{"wan"}
+				netNames := []string{"auto"}
+				netSubnets := []string{""}
+				netPrefixes := []int{0}
+				netIps := []string{"auto"}
+				if d.PrivateNetworkName != "" {
+					privateNetworkIp := d.PrivateNetworkIp
+					if d.PrivateNetworkIp == "" {
+						privateNetworkIp = "auto"
+					}
+					netModes = append(netModes, "lan")
+					netNames = append(netNames, d.PrivateNetworkName)
+					netSubnets = append(netSubnets, "")
+					netPrefixes = append(netPrefixes, 0)
+					netIps = append(netIps, privateNetworkIp)
 				}
-			}
-			body, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				if i >= 10 {
-					return errors.Wrap(err, "Failed to read Kamatera create server response body")
-				} else {
-					log.Debugf("Failed to read Kamatera create server response body: %s", err)
-					continue
+				if i > 0 || d.ServerName == "" {
+					if err := d.generateServerName(); err != nil {return err}
 				}
-			}
-			if r.StatusCode != 200 {
-				if r.StatusCode == 500 {
-					return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", string(body)))
+				userScript, userData, err := d.renderTemplates()
+				if err != nil {return err}
+				script := d.startupScriptWithHostKey(hostKeyPEM, userScript)
+				postValues := CreateServerPostValues{
+					Datacenter:          d.Datacenter,
+					NServers:            1,
+					Names:               []string{d.ServerName},
+					CpuStr:              d.Cpu,
+					CpuType:             d.Cpu[len(d.Cpu)-1:],
+					RamMB:               d.Ram,
+					DiskSizesGB:         diskSizesGB,
+					Password:            generatePassword,
+					PasswordValidate:    generatePassword,
+					Managed:             d.Managed,
+					Backup:              d.Backup,
+					BillingMode:         billingMode,
+					TrafficPackage:      d.Traffic,
+					UseSimpleNetworking: false,
+					PowerOnCompletion:   true,
+					UseSimpleWan:        false,
+					UseSimpleLan:        false,
+					NetModes:            netModes,
+					NetNames:            netNames,
+					NetSubnets:          netSubnets,
+					NetPrefixes:         netPrefixes,
+					NetIps:              netIps,
+					DiskImageId:         d.DiskImageId,
+					SourceServerId:      "",
+					UserId:              0,
+					OwnerId:             0,
+					SrcUI:               false,
+					SelectedKey:         d.SelectedSSHKeyId,
+					Script:              script,
+					SelectedSSHKeyValue: pkey,
+					SelectedTags:        tags,
+					UserData:            userData,
 				}
-				log.Info(string(body))
-				if i >= 10 {
-					return errors.New(fmt.Sprintf("Invalid Kamatera create server response status: %d", r.StatusCode))
-				} else {
-					log.Debugf("Got invalid status code: %d", r.StatusCode)
-					continue
+				log.Debugf("POST https://console.kamatera.com/svc/serverCreate %s", d.redactPostValues(postValues))
+				log.Debugf("Create (%d): %s", i, time.Now())
+				if i > 0 {
+					log.Debugf("Retry %d / 10", i)
+					time.Sleep(time.Duration(i * 6000) * time.Millisecond)
 				}
-			} else {
-				log.Debug(string(body))
-			}
-			var CreateServerResponse []int
-			err = json.Unmarshal(body, &CreateServerResponse)
-			if err != nil {
-				if i >= 10 {
-					return errors.Wrap(err, "Invalid JSON response from Kamatera create server")
+				i += 1
+				buf := new(bytes.Buffer)
+				if e := json.NewEncoder(buf).Encode(postValues); e != nil {
+					return e
+				}
+				req, e := http.NewRequest("POST", "https://console.kamatera.com/svc/serverCreate", buf)
+				if e != nil {
+					return e
+				}
+				req.Header.Add("User-Agent", "docker-machine-driver-kamatera/v0.0.0")
+				req.Header.Add("Host", "console.kamatera.com")
+				req.Header.Add("Accept", "application/json")
+				req.Header.Add("Content-Type", "application/json")
+				req.Header.Add("AuthClientId", clientID)
+				req.Header.Add("AuthSecret", secret)
+				r, err := http.DefaultClient.Do(req)
+				if err != nil {
+					if i >= 10 {
+						return errors.Wrap(err, "Unexpected error")
+					} else {
+						log.Debugf("Unexpected error: %s", err)
+						continue
+					}
+				}
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					if i >= 10 {
+						return errors.Wrap(err, "Failed to read Kamatera create server response body")
+					} else {
+						log.Debugf("Failed to read Kamatera create server response body: %s", err)
+						continue
+					}
+				}
+				if r.StatusCode != 200 {
+					if r.StatusCode == 500 {
+						return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", d.redact(string(body))))
+					}
+					log.Info(d.redact(string(body)))
+					if i >= 10 {
+						return errors.New(fmt.Sprintf("Invalid Kamatera create server response status: %d", r.StatusCode))
+					} else {
+						log.Debugf("Got invalid status code: %d", r.StatusCode)
+						continue
+					}
 				} else {
-					log.Debugf("Failed to parse Kamatera create server response body: %s", err)
-					continue
+					log.Debug(d.redact(string(body)))
 				}
+				var CreateServerResponse []int
+				err = json.Unmarshal(body, &CreateServerResponse)
+				if err != nil {
+					if i >= 10 {
+						return errors.Wrap(err, "Invalid JSON response from Kamatera create server")
+					} else {
+						log.Debugf("Failed to parse Kamatera create server response body: %s", err)
+						continue
+					}
+				}
+				defer r.Body.Close()
+				d.CreateServerCommandId = CreateServerResponse[0]
+				return nil
 			}
-			defer r.Body.Close()
-			d.CreateServerCommandId = CreateServerResponse[0]
-			break
 		}
+		if err := postCreateServer(); err != nil {
+			// no server uses the uploaded key if the create server command wasn't started
+			d.removeUploadedSSHKey()
+			return err
+		}
+	}
+	waitAndInitialize := func() error {
+		createServerLog, err := d.waitForCreateServerCommand()
+		if err != nil {return err}
+		return d.initializeServer(createServerLog)
+	}
+	if resumed {
+		// the server wasn't created by this run, so it's not terminated on failure
+		return waitAndInitialize()
 	}
+	return d.withRollbackOnFailure(waitAndInitialize)
+}
+
+// waitForCreateServerCommand waits for the create server command to complete and returns its log
+func (d *Driver) waitForCreateServerCommand() (string, error) {
 	log.Infof("Waiting for Kamatera create server command to complete...")
 	log.Infof("You can track progress in the Kamatera console web-ui (Command ID = %d)", d.CreateServerCommandId)
-	createServerLog := ""
 	for {
 		log.Debugf("Create/wait: %s", time.Now())
-		time.Sleep(2 * time.Second)
-		resp, err := resty.R().SetHeader("AuthClientId", d.APIClientID).
-			SetHeader("AuthSecret", d.APISecret).SetResult(KamateraServerCommandInfo{}).
+		if err := d.sleep(2 * time.Second); err != nil {return "", err}
+		req, err := d.apiRequest()
+		if err != nil {return "", err}
+		resp, err := req.SetResult(KamateraServerCommandInfo{}).
 			Get(fmt.Sprintf("https://console.kamatera.com/service/queue/%d", d.CreateServerCommandId))
-		if err != nil {return errors.Wrap(err, fmt.Sprintf("Failed to get Kamatera command info (%d)", d.CreateServerCommandId))}
+		if err != nil {return "", errors.Wrap(err, fmt.Sprintf("Failed to get Kamatera command info (%d)", d.CreateServerCommandId))}
 		if resp.StatusCode() == 200 {
 			res := resp.Result().(*KamateraServerCommandInfo)
 			log.Debugf("%s", res.Status)
-			log.Debugf("%s", res.Log)
-			createServerLog = res.Log
-			if res.Status == "complete" {break}
-			if res.Status == "error" {return errors.New("Kamatera create server failed")}
-			if res.Status == "cancelled" {return errors.New("Kamatera create server cancelled")}
+			log.Debugf("%s", d.redact(res.Log))
+			if res.Status == "complete" {
+				log.Infof("Kamatera create server command completed successfully (%s)", time.Now())
+				return res.Log, nil
+			}
+			if res.Status == "error" {return "", errors.New("Kamatera create server failed")}
+			if res.Status == "cancelled" {return "", errors.New("Kamatera create server cancelled")}
 		} else {
 			if resp.StatusCode() == 404 {
 				log.Infof("Waiting for command to start...")
 				continue
 			}
 			if resp.StatusCode() == 500 {
-				return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
+				return "", errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", d.redact(resp.String())))
 			}
-			log.Infof(resp.String())
+			log.Infof(d.redact(resp.String()))
 			log.Infof("Got invalid status code: %d, retrying...", resp.StatusCode())
 		}
 	}
-	log.Infof("Kamatera create server command completed successfully (%s)", time.Now())
+}
+
+var errInterrupted = errors.New("Interrupted")
+
+// sleep waits for the duration, returns errInterrupted if Create is interrupted meanwhile
+func (d *Driver) sleep(duration time.Duration) error {
+	select {
+	case <-time.After(duration):
+		return nil
+	case <-d.interrupted:
+		return errInterrupted
+	}
+}
+
+// withRollbackOnFailure runs fn once the Kamatera create server command was started, if fn fails
+// or the driver is interrupted the server is terminated unless --kamatera-keep-on-failure is set.
+// docker-machine exits on interrupt and the plugin is killed shortly after, so on interrupt the
+// termination is requested before anything else and isn't waited for, then fn is stopped at its
+// next wait (see sleep).
+func (d *Driver) withRollbackOnFailure(fn func() error) error {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+	d.interrupted = make(chan struct{})
+	done := make(chan error, 1)
+	go func() {done <- fn()}()
+	select {
+	case err := <-done:
+		if err != nil {
+			d.rollbackServer(err)
+		}
+		return err
+	case sig := <-interrupts:
+		// the docker-machine output pipes are closed, writing to them must not kill the plugin
+		signal.Ignore(syscall.SIGPIPE)
+		close(d.interrupted)
+		var serverId string
+		var commandId int
+		var terminateErr error
+		if ! d.KeepOnFailure {
+			serverId, commandId, terminateErr = d.terminateInterrupted()
+		}
+		log.Warnf("Interrupted by signal: %s", sig)
+		if d.KeepOnFailure {
+			log.Warnf("Keeping Kamatera server %s (--%s is set), remove it manually when done", d.ServerName, flagKeepOnFailure)
+		} else if terminateErr != nil {
+			log.Errorf("Failed to terminate Kamatera server %s, please remove it manually from the Kamatera console: %s", d.ServerName, terminateErr)
+		} else {
+			log.Warnf("Requested termination of Kamatera server %s (server id = %s, command id = %d), check in the Kamatera console that it was removed", d.ServerName, serverId, commandId)
+		}
+		<-done
+		return errors.Errorf("Interrupted by signal: %s", sig)
+	}
+}
+
+// terminateInterrupted requests the termination of the server being created without waiting for it,
+// it only reads the server name as fn may still be running
+func (d *Driver) terminateInterrupted() (string, int, error) {
+	servers, err := d.listServers()
+	if err != nil {return "", 0, err}
+	for _, server := range servers {
+		if server.Name == d.ServerName {
+			commandId, err := d.requestTerminateServer(server.Id)
+			return server.Id, commandId, err
+		}
+	}
+	return "", 0, errKamateraServerNotFound
+}
+
+func (d *Driver) rollbackServer(cause error) {
+	log.Errorf("Machine creation failed after Kamatera server was created (server name = %s): %s", d.ServerName, cause)
+	if d.KeepOnFailure {
+		log.Warnf("Keeping Kamatera server %s (--%s is set), remove it manually when done", d.ServerName, flagKeepOnFailure)
+		return
+	}
+	log.Infof("Terminating Kamatera server %s...", d.ServerName)
+	if err := d.remove(true); err != nil {
+		log.Errorf("Failed to terminate Kamatera server (server name = %s, server id = %s), please remove it manually from the Kamatera console: %s", d.ServerName, d.KamateraServerId, err)
+		return
+	}
+	log.Infof("Kamatera server %s (server id = %s) terminated", d.ServerName, d.KamateraServerId)
+}
+
+func (d *Driver) initializeServer(createServerLog string) error {
 	var pattern = regexp.MustCompile(` ([0-9]+.[0-9]+.[0-9]+.[0-9]+) `)
 	d.IPAddress = strings.Trim(pattern.FindString(createServerLog), " ")
 	log.Debugf("Server IP = '%s'", d.IPAddress)
-	log.Debugf("Generating SSH key...")
-	if err := mcnssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
-		return errors.Wrap(err, "could not generate ssh key")
+	if d.IPAddress == "" {
+		return errors.New("Failed to find server IP in Kamatera create server command log")
 	}
-	buf, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
-	if err != nil {
-		return errors.Wrap(err, "could not read ssh public key")
-	}
-	pkey := string(buf)
 	log.Debugf("Waiting for server status...")
 	for {
 		log.Debugf("Create/wait-status: %s", time.Now())
-		time.Sleep(2 * time.Second)
+		if err := d.sleep(2 * time.Second); err != nil {return err}
 		srvstate, _ := d.GetState()
 		if srvstate == state.Running {break}
 	}
-	config := &ssh.ClientConfig{
-		User: "root",
-		Auth: []ssh.AuthMethod{
-			ssh.Password(d.Password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	log.Debugf("Connecting to the server and performing initialization")
+	client, err := d.waitForSSH("root", defaultSSHPort)
+	if err != nil {return err}
+	defer client.Close()
+	serverOS, err := detectServerOS(client)
+	if err != nil {return err}
+	keys, err := d.authorizedKeys()
+	if err != nil {return err}
+	users := []string{"root"}
+	if d.SSHUser != "root" {
+		log.Debugf("Creating SSH user %s", d.SSHUser)
+		if _, err := runSSHCommand(client, serverOS.ensureSudoCmd()); err != nil {
+			return errors.Wrap(err, "Failed to install sudo on the Kamatera server")
+		}
+		if _, err := runSSHCommand(client, createSSHUserCmd(d.SSHUser)); err != nil {
+			return errors.Wrap(err, "Failed to create SSH user on the Kamatera server")
+		}
+		users = append(users, d.SSHUser)
 	}
-	log.Debugf("Copying SSH key to the server and performing initialization")
-	for {
-		log.Debugf("Create/ssh: %s", time.Now())
-		time.Sleep(2 * time.Second)
-		client, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", d.IPAddress), config)
-		if err == nil {
-			session, err := client.NewSession()
-			if err == nil {
-				defer session.Close()
-				var b bytes.Buffer
-				session.Stdout = &b
-				cmd := fmt.Sprintf("bash -c 'mkdir -p .ssh && echo \"%s\" >> .ssh/authorized_keys'", pkey)
-				log.Debugf("Running ssh cmd: %s", cmd)
-				err = session.Run(cmd)
-				if err != nil {return errors.Wrap(err, "Failed to copy SSH key to the Kamatera server")}
-				log.Debugf("SSH Initialization completed successfully (%s)", time.Now())
-				return nil
-			}
-		} else {
-			log.Debugf("SSH failure (%s): %s", time.Now(), err)
+	for _, user := range users {
+		log.Debugf("Installing %d SSH keys for user %s", len(keys), user)
+		if err := installAuthorizedKeys(client, user, keys); err != nil {
+			return errors.Wrapf(err, "Failed to install SSH keys for user %s on the Kamatera server", user)
 		}
 	}
+	if err := d.mountExtraDisks(client); err != nil {return err}
+	if d.WaitForInit {
+		if err := d.waitForInit(client); err != nil {return err}
+	}
+	log.Debugf("Disabling SSH password authentication")
+	if _, err := runSSHCommand(client, serverOS.sshdConfigCmd("PasswordAuthentication", "no")); err != nil {
+		return errors.Wrap(err, "Failed to disable SSH password authentication on the Kamatera server")
+	}
+	if d.DisableRootLogin {
+		log.Debugf("Disabling SSH root login")
+		if _, err := runSSHCommand(client, serverOS.sshdConfigCmd("PermitRootLogin", "no")); err != nil {
+			return errors.Wrap(err, "Failed to disable SSH root login on the Kamatera server")
+		}
+	}
+	if d.SSHPort != defaultSSHPort {
+		log.Debugf("Changing SSH port to %d", d.SSHPort)
+		if _, err := runSSHCommand(client, serverOS.sshPortCmd(d.SSHPort)); err != nil {
+			return errors.Wrap(err, "Failed to change SSH port on the Kamatera server")
+		}
+		portClient, err := d.waitForSSH(d.GetSSHUsername(), d.SSHPort)
+		if err != nil {return errors.Wrapf(err, "Failed to connect to the Kamatera server on SSH port %d", d.SSHPort)}
+		portClient.Close()
+	}
+	log.Debugf("SSH Initialization completed successfully (%s)", time.Now())
+	return nil
 }
 
 func (d *Driver) GetSSHHostname() (string, error) {
@@ -810,17 +1246,18 @@ func (d *Driver) getKamateraServerPower() (string, error) {
 		log.Debugf("getKamateraServerPower: %s", time.Now())
 		if i > 0 {time.Sleep(2000 + time.Duration(i * 3000) * time.Millisecond)}
 		i += 1
-		resp, err := resty.R().SetHeader("AuthClientId", d.APIClientID).
-			SetHeader("AuthSecret", d.APISecret).Get("https://console.kamatera.com/service/servers")
+		req, err := d.apiRequest()
+		if err != nil {return "", err}
+		resp, err := req.Get("https://console.kamatera.com/service/servers")
 		if err != nil {return "", errors.Wrap(err, "Failed to get Kamatera server power")}
 		if resp.StatusCode() != 200 {
 			if resp.StatusCode() == 404 {
 				return "", errors.New("Kamatera resource not found")
 			}
 			if resp.StatusCode() == 500 {
-				return "", errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
+				return "", errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", d.redact(resp.String())))
 			}
-			log.Info(resp.String())
+			log.Info(d.redact(resp.String()))
 			if i >= 10 {
 				return "", errors.New(fmt.Sprintf("Invalid Kamatera server power status: %d", resp.StatusCode()))
 			} else {
@@ -828,12 +1265,12 @@ func (d *Driver) getKamateraServerPower() (string, error) {
 				continue
 			}
 		}
-		log.Debug(resp.String())
+		log.Debug(d.redact(resp.String()))
 		var servers []KamateraServerListInfo
 		json.Unmarshal(resp.Body(), &servers)
 		serverPower := ""
 		for _, server := range servers {
-			if server.Name == d.ServerName {
+			if server.Name == d.ServerName || (d.KamateraServerId != "" && server.Id == d.KamateraServerId) {
 				serverPower = server.Power
 				break
 			}
@@ -843,84 +1280,92 @@ func (d *Driver) getKamateraServerPower() (string, error) {
 }
 
 func (d *Driver) getKamateraServerId() (string, error) {
+	// the machine tag isn't unique across machine stores, it's only used when there is no server name
+	return d.findKamateraServerId(d.ServerName == "")
+}
+
+// findKamateraServerId finds the server by its stored ID or name, and optionally by its machine tag
+func (d *Driver) findKamateraServerId(byTag bool) (string, error) {
 	if d.KamateraServerId == "" {
-		i := 0
-		for {
-			log.Debugf("Getting kamatera server id (%s): %d", time.Now(), i)
-			if i > 0 {time.Sleep(2000 + time.Duration(i * 3000) * time.Millisecond)}
-			i += 1
-			resp, err := resty.R().SetHeader("AuthClientId", d.APIClientID).
-				SetHeader("AuthSecret", d.APISecret).Get("https://console.kamatera.com/service/servers")
-			if err != nil {return "", errors.Wrap(err, "Failed to get Kamatera servers list")}
-			if resp.StatusCode() != 200 {
-				if resp.StatusCode() == 404 {
-					return "", errors.New("Kamatera resource not found")
-				}
-				if resp.StatusCode() == 500 {
-					return "", errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
-				}
-				log.Info(resp.String())
-				if i >= 10 {
-					return "", errors.New(fmt.Sprintf("Invalid Kamatera servers status: %d", resp.StatusCode()))
-				} else {
-					log.Debugf("Got invalid status code: %d, retrying... %d/10", resp.StatusCode(), i)
-					continue
-				}
+		servers, err := d.listServers()
+		if err != nil {return "", err}
+		for _, server := range servers {
+			if d.ServerName != "" && server.Name == d.ServerName {
+				d.KamateraServerId = server.Id
+				break
 			}
-			var servers []KamateraServerListInfo
-			json.Unmarshal(resp.Body(), &servers)
-			serverId := ""
-			for _, server := range servers {
-				if server.Name == d.ServerName {
-					serverId = server.Id
-					break
-				}
+		}
+		if d.KamateraServerId == "" {
+			if ! byTag {return "", errKamateraServerNotFound}
+			servers, err := d.FindServersByTag(d.machineTag())
+			if err != nil {return "", err}
+			if len(servers) > 1 {
+				return "", errors.New(fmt.Sprintf("Found %d Kamatera servers with tag %s", len(servers), d.machineTag()))
 			}
-			if serverId == "" {
-				return "", errors.Wrap(err, "Failed to find Kamatera server ID")
-			} else {
-				d.KamateraServerId = serverId
+			if len(servers) == 0 {
+				return "", errKamateraServerNotFound
 			}
-			break
+			d.KamateraServerId = servers[0].Id
 		}
 	}
 	return d.KamateraServerId, nil
 }
 
 func (d *Driver) Remove() error {
-	serverId, err := d.getKamateraServerId()
-	if err != nil {return err}
+	force, _ := strconv.ParseBool(os.Getenv(envForce))
+	return d.remove(force)
+}
+
+// remove terminates the server, a server which doesn't exist is considered removed. With
+// --kamatera-protect-running a running server is only removed if force is set.
+func (d *Driver) remove(force bool) error {
+	if d.ProtectRunning && ! force {
+		power, err := d.getKamateraServerPower()
+		if err != nil {return err}
+		if power == "on" {
+			return errors.New(fmt.Sprintf("Kamatera server %s is running and --%s is set, stop the machine or set %s=1 to remove it", d.ServerName, flagProtectRunning, envForce))
+		}
+	}
+	if err := d.terminateServer(); err != nil {
+		if err != errKamateraServerNotFound {return err}
+		log.Infof("Kamatera server %s not found, it was already removed", d.ServerName)
+	}
+	d.removeUploadedSSHKey()
+	return nil
+}
+
+func (d *Driver) terminateServer() error {
+	// never terminate a server found only by its machine tag, it may belong to another machine store
+	serverId, err := d.findKamateraServerId(false)
+	if err == errKamateraServerNotFound {return err}
+	if err != nil {return errors.Wrap(err, "Failed to get server id for remove")}
 	log.Debugf("Removing Kamatera server ID %s", serverId)
-	i := 0
-	for {
-		log.Debugf("Removing server (%s): %d", time.Now(), i)
-		if i > 0 {time.Sleep(2000 + time.Duration(i * 3000) * time.Millisecond)}
-		i += 1
-		resp, err := resty.R().SetHeader("AuthClientId", d.APIClientID).SetHeader("AuthSecret", d.APISecret).
-			SetFormData(map[string]string{"confirm":"1","force":"1"}).
-			Delete(fmt.Sprintf("https://console.kamatera.com/service/server/%s/terminate", serverId))
-		if err != nil {return errors.Wrap(err, "Failed to run terminate operation")}
-		if resp.StatusCode() != 200 {
-			if resp.StatusCode() == 404 {
-				return errors.New("Kamatera resource not found")
-			}
-			if resp.StatusCode() == 500 {
-				return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
-			}
-			log.Info(resp.String())
-			if i >= 10 {
-				return errors.New(fmt.Sprintf("Invalid Kamatera remove server status: %d", resp.StatusCode()))
-			} else {
-				log.Infof("Got invalid status code: %d, retrying... %d/10", resp.StatusCode(), i)
-				continue
-			}
+	removeServerCommandId, err := d.requestTerminateServer(serverId)
+	if err != nil {return err}
+	if err := d.waitForCommandTimeout("remove server", removeServerCommandId, removeServerTimeout); err != nil {return err}
+	servers, err := d.listServers()
+	if err != nil {return errors.Wrap(err, "Failed to verify the Kamatera server was removed")}
+	for _, server := range servers {
+		if server.Id == serverId {
+			return errors.New(fmt.Sprintf("Kamatera server %s (server id = %s) still exists after remove", d.ServerName, serverId))
 		}
-		var removeServerCommandId int
-		err = json.Unmarshal(resp.Body(), &removeServerCommandId)
-		if err != nil {return errors.Wrap(err, "Invalid JSON response from Kamatera remove server")}
-		log.Infof("Kamatera remove server started, track progress in Kamatera console, command id = %d", removeServerCommandId)
-		return nil
 	}
+	return nil
+}
+
+// requestTerminateServer starts the termination of the server and returns the queue command id
+func (d *Driver) requestTerminateServer(serverId string) (int, error) {
+	resp, err := d.apiCall("remove server", func(req *resty.Request) (*resty.Response, error) {
+		return req.SetFormData(map[string]string{"confirm":"1","force":"1"}).
+			Delete(fmt.Sprintf("https://console.kamatera.com/service/server/%s/terminate", serverId))
+	})
+	// only a missing server on terminate means it was already removed
+	if err == errKamateraNotFound {return 0, errKamateraServerNotFound}
+	if err != nil {return 0, err}
+	var removeServerCommandId int
+	err = json.Unmarshal(resp.Body(), &removeServerCommandId)
+	if err != nil {return 0, errors.Wrap(err, "Invalid JSON response from Kamatera remove server")}
+	return removeServerCommandId, nil
 }
 
 func (d *Driver) kamateraPower(power string) error {
@@ -932,8 +1377,9 @@ func (d *Driver) kamateraPower(power string) error {
 		log.Debugf("Running power operation (%s): %d", time.Now(), i)
 		if i > 0 {time.Sleep(2000 + time.Duration(i * 3000) * time.Millisecond)}
 		i += 1
-		resp, err := resty.R().SetHeader("AuthClientId", d.APIClientID).SetHeader("AuthSecret", d.APISecret).
-			SetFormData(map[string]string{"power":power}).
+		req, err := d.apiRequest()
+		if err != nil {return err}
+		resp, err := req.SetFormData(map[string]string{"power":power}).
 			Put(fmt.Sprintf("https://console.kamatera.com/service/server/%s/power", serverId))
 		if err != nil {return errors.Wrap(err, "Failed to run power operation")}
 		if resp.StatusCode() != 200 {
@@ -941,9 +1387,9 @@ func (d *Driver) kamateraPower(power string) error {
 				return errors.New("Kamatera resource not found")
 			}
 			if resp.StatusCode() == 500 {
-				return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
+				return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", d.redact(resp.String())))
 			}
-			log.Infof(resp.String())
+			log.Infof(d.redact(resp.String()))
 			if i >= 10 {
 				return errors.New(fmt.Sprintf("Invalid Kamatera power operation status: %d", resp.StatusCode()))
 			}
@@ -953,40 +1399,7 @@ func (d *Driver) kamateraPower(power string) error {
 		var powerOperationCommandId int
 		err = json.Unmarshal(resp.Body(), &powerOperationCommandId)
 		if err != nil {return errors.Wrap(err, "Invalid JSON response from Kamatera power operation")}
-		log.Info("Waiting for Kamatera power operation to complete")
-		log.Infof("track progress in Kamatera console, command id = %d", powerOperationCommandId)
-		for {
-			log.Debugf("Waiting for power operation (%s)", time.Now())
-			time.Sleep(2000 * time.Millisecond)
-			resp, err := resty.R().SetHeader("AuthClientId", d.APIClientID).
-				SetHeader("AuthSecret", d.APISecret).SetResult(KamateraPowerOperationInfo{}).
-				Get(fmt.Sprintf("https://console.kamatera.com/service/queue/%d", powerOperationCommandId))
-			if err != nil {return errors.Wrap(err, fmt.Sprintf("Failed to get Kamatera command info (%d)", powerOperationCommandId))}
-			if resp.StatusCode() != 200 {
-				if resp.StatusCode() == 500 {
-					return errors.New(fmt.Sprintf("Kamatera API responded with the following error: %s", resp.String()))
-				}
-				log.Info(resp.String())
-				if i >= 10 {
-					return errors.New(fmt.Sprintf("Invalid Kamatera power operation wait status: %d", resp.StatusCode()))
-				} else {
-					log.Infof("Got invalid status code: %d, retrying...", resp.StatusCode())
-					if resp.StatusCode() == 500 {
-						return d.kamateraPower(power)
-					} else {
-						continue
-					}
-				}
-			}
-			res := resp.Result().(*KamateraPowerOperationInfo)
-			log.Debugf("%s", res.Status)
-			if res.Status == "complete" {
-				log.Infof("Kamatera power operation completed successfully")
-				return nil
-			}
-			if res.Status == "error" {return errors.New("Kamatera power operation failed")}
-			if res.Status == "cancelled" {return errors.New("Kamatera power operation cancelled")}
-		}
+		return d.waitForCommand("power operation", powerOperationCommandId)
 	}
 }
 
@@ -998,10 +1411,45 @@ func (d *Driver) Start() error {
 	return d.kamateraPower("on")
 }
 
+// Stop shuts down the server gracefully over SSH, if it doesn't stop within the stop timeout
+// (or SSH fails) the server is powered off
 func (d *Driver) Stop() error {
+	if d.StopTimeout <= 0 {
+		return d.kamateraPower("off")
+	}
+	if srvstate, err := d.GetState(); err == nil && srvstate == state.Stopped {
+		return nil
+	}
+	if err := d.shutdown(); err != nil {
+		log.Warnf("Graceful shutdown failed, powering off: %s", err)
+		return d.kamateraPower("off")
+	}
+	deadline := time.Now().Add(time.Duration(d.StopTimeout) * time.Second)
+	for time.Now().Before(deadline) {
+		log.Debugf("Waiting for shutdown (%s)", time.Now())
+		time.Sleep(5 * time.Second)
+		srvstate, _ := d.GetState()
+		if srvstate == state.Stopped {
+			log.Infof("Kamatera server shut down")
+			return nil
+		}
+	}
+	log.Warnf("Kamatera server didn't shut down within %d seconds, powering off", d.StopTimeout)
 	return d.kamateraPower("off")
 }
 
+func (d *Driver) shutdown() error {
+	log.Infof("Shutting down Kamatera server %s", d.ServerName)
+	client, err := d.dialSSH()
+	if err != nil {return err}
+	defer client.Close()
+	// the connection may be closed by the shutdown before the command returns
+	out, err := runSSHCommand(client, sudoCmd(d.GetSSHUsername(), "shutdown -h now"))
+	if err != nil && strings.TrimSpace(out) != "" {return err}
+	return nil
+}
+
+// Kill powers off the server without shutting it down
 func (d *Driver) Kill() error {
-	return d.Stop()
+	return d.kamateraPower("off")
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	configEncryptionPassphrase = "passphrase"
+	configEncryptionAge = "age"
+
+	envConfigEncryptionKey = "KAMATERA_CONFIG_ENCRYPTION_KEY"
+	envConfigAgeIdentityFile = "KAMATERA_CONFIG_AGE_IDENTITY_FILE"
+)
+
+// driverJSON has the same fields as Driver without the custom JSON methods
+type driverJSON Driver
+
+// sensitiveFields are the fields which are encrypted in the persisted machine config
+func (d *Driver) sensitiveFields() map[string]*string {
+	return map[string]*string{
+		"APISecret": &d.APISecret,
+		"StartupScript": &d.StartupScript,
+		"StartupScriptString": &d.StartupScriptString,
+		"UserData": &d.UserData,
+		"UserDataString": &d.UserDataString,
+	}
+}
+
+// MarshalJSON serializes the driver config, when config encryption is enabled
+// the sensitive fields are encrypted into EncryptedFields
+func (d *Driver) MarshalJSON() ([]byte, error) {
+	if d.ConfigEncryption == "" {
+		return json.Marshal((*driverJSON)(d))
+	}
+	encrypted := *d
+	fields := map[string]string{}
+	for name, value := range encrypted.sensitiveFields() {
+		if *value != "" {
+			fields[name] = *value
+			*value = ""
+		}
+	}
+	plaintext, err := json.Marshal(fields)
+	if err != nil {return nil, err}
+	encrypted.EncryptedFields, err = d.encryptConfig(plaintext)
+	if err != nil {return nil, errors.Wrap(err, "Failed to encrypt Kamatera machine config")}
+	return json.Marshal((*driverJSON)(&encrypted))
+}
+
+// UnmarshalJSON deserializes the driver config and decrypts the sensitive fields
+func (d *Driver) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*driverJSON)(d)); err != nil {return err}
+	if d.EncryptedFields == "" {return nil}
+	plaintext, err := d.decryptConfig(d.EncryptedFields)
+	if err != nil {return errors.Wrap(err, "Failed to decrypt Kamatera machine config")}
+	fields := map[string]string{}
+	if err := json.Unmarshal(plaintext, &fields); err != nil {
+		return errors.Wrap(err, "Invalid decrypted Kamatera machine config")
+	}
+	for name, value := range d.sensitiveFields() {
+		if fieldValue, ok := fields[name]; ok {
+			*value = fieldValue
+		}
+	}
+	d.EncryptedFields = ""
+	return nil
+}
+
+// setConfigEncryption enables config encryption with an age recipient, a passphrase key file,
+// or the passphrase from KAMATERA_CONFIG_ENCRYPTION_KEY, if none of them is set it's disabled
+func (d *Driver) setConfigEncryption(keyFile string, ageRecipient string, ageIdentityFile string) error {
+	d.ConfigEncryptionKeyFile = keyFile
+	d.ConfigAgeRecipient = ageRecipient
+	d.ConfigAgeIdentityFile = ageIdentityFile
+	if ageRecipient != "" {
+		if keyFile != "" {
+			return errors.New("Can't use both an encryption key file and an age recipient for config encryption")
+		}
+		if _, err := exec.LookPath("age"); err != nil {
+			return errors.Wrap(err, "age binary is required for config encryption with an age recipient")
+		}
+		d.ConfigEncryption = configEncryptionAge
+	} else if keyFile != "" || os.Getenv(envConfigEncryptionKey) != "" {
+		d.ConfigEncryption = configEncryptionPassphrase
+	} else {
+		d.ConfigEncryption = ""
+	}
+	return nil
+}
+
+func (d *Driver) configPassphrase() ([]byte, error) {
+	if d.ConfigEncryptionKeyFile != "" {
+		buf, err := ioutil.ReadFile(d.ConfigEncryptionKeyFile)
+		if err != nil {return nil, errors.Wrap(err, "Failed to read config encryption key file")}
+		passphrase := strings.TrimSpace(string(buf))
+		if passphrase == "" {return nil, errors.New("Config encryption key file is empty")}
+		return []byte(passphrase), nil
+	}
+	if passphrase := os.Getenv(envConfigEncryptionKey); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, errors.Errorf("Config encryption key is not available, set %s or --%s", envConfigEncryptionKey, flagConfigEncryptionKeyFile)
+}
+
+// encryptConfig encrypts using age or AES-GCM with a key derived from the passphrase using scrypt,
+// the passphrase ciphertext is encoded as base64(salt | nonce | sealed data)
+func (d *Driver) encryptConfig(plaintext []byte) (string, error) {
+	if d.ConfigEncryption == configEncryptionAge {
+		ciphertext, err := runAge(plaintext, "-r", d.ConfigAgeRecipient)
+		if err != nil {return "", err}
+		return configEncryptionAge + ":" + base64.StdEncoding.EncodeToString(ciphertext), nil
+	}
+	passphrase, err := d.configPassphrase()
+	if err != nil {return "", err}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {return "", err}
+	gcm, err := newConfigCipher(passphrase, salt)
+	if err != nil {return "", err}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {return "", err}
+	ciphertext := append(append(salt, nonce...), gcm.Seal(nil, nonce, plaintext, nil)...)
+	return configEncryptionPassphrase + ":" + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (d *Driver) decryptConfig(encrypted string) ([]byte, error) {
+	parts := strings.SplitN(encrypted, ":", 2)
+	if len(parts) != 2 {return nil, errors.New("Invalid encrypted config format")}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {return nil, errors.Wrap(err, "Invalid encrypted config encoding")}
+	switch parts[0] {
+	case configEncryptionAge:
+		identityFile := os.Getenv(envConfigAgeIdentityFile)
+		if identityFile == "" {identityFile = d.ConfigAgeIdentityFile}
+		if identityFile == "" {
+			return nil, errors.Errorf("age identity file is required to decrypt the config, set %s or --%s", envConfigAgeIdentityFile, flagConfigAgeIdentityFile)
+		}
+		return runAge(ciphertext, "-d", "-i", identityFile)
+	case configEncryptionPassphrase:
+		passphrase, err := d.configPassphrase()
+		if err != nil {return nil, err}
+		if len(ciphertext) < 16 {return nil, errors.New("Invalid encrypted config")}
+		gcm, err := newConfigCipher(passphrase, ciphertext[:16])
+		if err != nil {return nil, err}
+		ciphertext = ciphertext[16:]
+		if len(ciphertext) < gcm.NonceSize() {return nil, errors.New("Invalid encrypted config")}
+		plaintext, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+		if err != nil {return nil, errors.New("Invalid config encryption key")}
+		return plaintext, nil
+	default:
+		return nil, errors.Errorf("Unsupported config encryption: %s", parts[0])
+	}
+}
+
+func newConfigCipher(passphrase []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 32768, 8, 1, 32)
+	if err != nil {return nil, err}
+	block, err := aes.NewCipher(key)
+	if err != nil {return nil, err}
+	return cipher.NewGCM(block)
+}
+
+func runAge(input []byte, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("age", args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "age failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
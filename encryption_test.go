@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyFile writes a passphrase key file to a temporary directory, the returned
+// function removes the directory
+func writeKeyFile(t *testing.T, passphrase string) (string, func()) {
+	dir, err := ioutil.TempDir("", "kamatera-encryption-test")
+	if err != nil {t.Fatal(err)}
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte(passphrase + "\n"), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return keyFile, func() {os.RemoveAll(dir)}
+}
+
+func newEncryptedDriver(t *testing.T, keyFile string) *Driver {
+	os.Unsetenv(envConfigEncryptionKey)
+	d := NewDriver()
+	d.MachineName = "test-machine"
+	d.APIClientID = "client-id"
+	d.APISecret = "api-secret-value"
+	d.StartupScriptString = "#!/bin/sh\necho startup-script-value\n"
+	d.StartupScript = d.StartupScriptString
+	d.UserDataString = "#cloud-config\npassword: user-data-value\n"
+	d.UserData = d.UserDataString
+	if err := d.setConfigEncryption(keyFile, "", ""); err != nil {t.Fatal(err)}
+	if d.ConfigEncryption != configEncryptionPassphrase {
+		t.Fatalf("expected passphrase config encryption, got %q", d.ConfigEncryption)
+	}
+	return d
+}
+
+func TestConfigEncryptionRoundTrip(t *testing.T) {
+	keyFile, cleanup := writeKeyFile(t, "correct horse battery staple")
+	defer cleanup()
+	d := newEncryptedDriver(t, keyFile)
+	data, err := json.Marshal(d)
+	if err != nil {t.Fatal(err)}
+	loaded := &Driver{}
+	if err := json.Unmarshal(data, loaded); err != nil {t.Fatal(err)}
+	for name, value := range d.sensitiveFields() {
+		if got := *loaded.sensitiveFields()[name]; got != *value {
+			t.Errorf("%s: expected %q, got %q", name, *value, got)
+		}
+	}
+	if loaded.APIClientID != d.APIClientID || loaded.MachineName != d.MachineName {
+		t.Errorf("unencrypted fields were not preserved: %+v", loaded)
+	}
+	if loaded.EncryptedFields != "" {
+		t.Errorf("expected EncryptedFields to be cleared after decryption")
+	}
+	if d.APISecret != "api-secret-value" {
+		t.Errorf("MarshalJSON modified the driver")
+	}
+}
+
+func TestConfigEncryptionMarshalHasNoPlaintext(t *testing.T) {
+	keyFile, cleanup := writeKeyFile(t, "correct horse battery staple")
+	defer cleanup()
+	d := newEncryptedDriver(t, keyFile)
+	data, err := json.Marshal(d)
+	if err != nil {t.Fatal(err)}
+	for _, secret := range []string{"api-secret-value", "startup-script-value", "user-data-value", "correct horse battery staple"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("marshaled config contains plaintext %q", secret)
+		}
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {t.Fatal(err)}
+	if ! strings.HasPrefix(raw["EncryptedFields"].(string), configEncryptionPassphrase + ":") {
+		t.Errorf("unexpected EncryptedFields: %v", raw["EncryptedFields"])
+	}
+}
+
+func TestConfigEncryptionWrongKey(t *testing.T) {
+	keyFile, cleanup := writeKeyFile(t, "correct horse battery staple")
+	defer cleanup()
+	data, err := json.Marshal(newEncryptedDriver(t, keyFile))
+	if err != nil {t.Fatal(err)}
+	if err := ioutil.WriteFile(keyFile, []byte("wrong passphrase"), 0600); err != nil {t.Fatal(err)}
+	err = json.Unmarshal(data, &Driver{})
+	if err == nil || ! strings.Contains(err.Error(), "Invalid config encryption key") {
+		t.Fatalf("expected invalid key error, got %v", err)
+	}
+}
+
+func TestConfigEncryptionMissingKey(t *testing.T) {
+	keyFile, cleanup := writeKeyFile(t, "correct horse battery staple")
+	data, err := json.Marshal(newEncryptedDriver(t, keyFile))
+	cleanup()
+	if err != nil {t.Fatal(err)}
+	if err := json.Unmarshal(data, &Driver{}); err == nil {
+		t.Fatal("expected an error when the key file is missing")
+	}
+}
+
+func TestConfigEncryptionTruncatedData(t *testing.T) {
+	keyFile, cleanup := writeKeyFile(t, "correct horse battery staple")
+	defer cleanup()
+	d := newEncryptedDriver(t, keyFile)
+	encrypted, err := d.encryptConfig([]byte(`{"APISecret":"api-secret-value"}`))
+	if err != nil {t.Fatal(err)}
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encrypted, configEncryptionPassphrase + ":"))
+	if err != nil {t.Fatal(err)}
+	// truncated within the salt, within the nonce and within the sealed data
+	for _, length := range []int{0, 8, 20, len(ciphertext) - 1} {
+		truncated := configEncryptionPassphrase + ":" + base64.StdEncoding.EncodeToString(ciphertext[:length])
+		if _, err := d.decryptConfig(truncated); err == nil {
+			t.Errorf("expected an error for ciphertext truncated to %d bytes", length)
+		}
+	}
+	for _, invalid := range []string{"", "passphrase", "passphrase:not-base64!", "unknown:" + base64.StdEncoding.EncodeToString(ciphertext)} {
+		if _, err := d.decryptConfig(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestConfigEncryptionDisabled(t *testing.T) {
+	os.Unsetenv(envConfigEncryptionKey)
+	d := NewDriver()
+	d.APISecret = "api-secret-value"
+	if err := d.setConfigEncryption("", "", ""); err != nil {t.Fatal(err)}
+	data, err := json.Marshal(d)
+	if err != nil {t.Fatal(err)}
+	loaded := &Driver{}
+	if err := json.Unmarshal(data, loaded); err != nil {t.Fatal(err)}
+	if loaded.APISecret != "api-secret-value" || loaded.EncryptedFields != "" {
+		t.Errorf("unexpected unencrypted round trip: %+v", loaded)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+)
+
+// OrphanServer is a Kamatera server created by the driver which has no docker-machine store entry
+type OrphanServer struct {
+	Server KamateraServerListInfo
+	Info *KamateraServerInfo
+}
+
+// Age returns how long ago the server was created, or empty string if unknown
+func (o *OrphanServer) Age() string {
+	if o.Info == nil || o.Info.Created == "" {return ""}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if created, err := time.Parse(layout, o.Info.Created); err == nil {
+			return time.Since(created).Truncate(time.Minute).String()
+		}
+	}
+	return o.Info.Created
+}
+
+// Cost returns the server price as reported by Kamatera, or empty string if unknown
+func (o *OrphanServer) Cost() string {
+	if o.Info == nil {return ""}
+	var prices []string
+	if o.Info.PriceHourlyOn != nil {prices = append(prices, fmt.Sprintf("%v/hour", o.Info.PriceHourlyOn))}
+	if o.Info.PriceMonthlyOn != nil {prices = append(prices, fmt.Sprintf("%v/month", o.Info.PriceMonthlyOn))}
+	return strings.Join(prices, ", ")
+}
+
+// storeServers returns the machine names, server names and server IDs of the Kamatera machines in the store,
+// the configs are read without decrypting the encrypted fields
+func storeServers(storagePath string) (map[string]bool, error) {
+	result := map[string]bool{}
+	dirs, err := ioutil.ReadDir(filepath.Join(storagePath, "machines"))
+	if err != nil {
+		// without the store all the servers would be considered orphans
+		return nil, errors.Wrapf(err, "Failed to read the docker-machine store at %s", storagePath)
+	}
+	for _, dir := range dirs {
+		if ! dir.IsDir() {continue}
+		buf, err := ioutil.ReadFile(machineConfigPath(storagePath, dir.Name()))
+		if err != nil {continue}
+		var config struct {
+			DriverName string
+			Driver struct {
+				MachineName string
+				ServerName string
+				KamateraServerId string
+			}
+		}
+		if err := json.Unmarshal(buf, &config); err != nil {
+			return nil, errors.Wrapf(err, "Invalid machine config for %s", dir.Name())
+		}
+		result[machineTagPrefix + dir.Name()] = true
+		if config.DriverName != "kamatera" {continue}
+		if config.Driver.ServerName != "" {result["name:" + config.Driver.ServerName] = true}
+		if config.Driver.KamateraServerId != "" {result["id:" + config.Driver.KamateraServerId] = true}
+	}
+	return result, nil
+}
+
+// FindOrphanServers returns the servers which have the managed-by tag or a name starting with namePrefix
+// and no corresponding machine in the store
+func (d *Driver) FindOrphanServers(storagePath string, namePrefix string) ([]OrphanServer, error) {
+	known, err := storeServers(storagePath)
+	if err != nil {return nil, err}
+	servers, err := d.listServers()
+	if err != nil {return nil, err}
+	var orphans []OrphanServer
+	for _, server := range servers {
+		managed := IsStringInArray(managedByTag, server.Tags)
+		if ! managed && (namePrefix == "" || ! strings.HasPrefix(server.Name, namePrefix)) {continue}
+		if known["name:" + server.Name] || known["id:" + server.Id] {continue}
+		hasMachine := false
+		for _, tag := range server.Tags {
+			if strings.HasPrefix(tag, machineTagPrefix) && known[tag] {hasMachine = true}
+		}
+		if hasMachine {continue}
+		orphan := OrphanServer{Server: server}
+		serverDriver := d.serverDriver(server)
+		if info, err := serverDriver.getServerInfo(); err != nil {
+			log.Warnf("Failed to get Kamatera server %s details: %s", server.Name, err)
+		} else {
+			orphan.Info = info
+		}
+		orphans = append(orphans, orphan)
+	}
+	return orphans, nil
+}
+
+// serverDriver returns a driver for the given server with the same API credentials
+func (d *Driver) serverDriver(server KamateraServerListInfo) *Driver {
+	serverDriver := *d
+	serverDriver.ServerName = server.Name
+	serverDriver.KamateraServerId = server.Id
+	return &serverDriver
+}
+
+// TerminateOrphanServer terminates an orphan server
+func (d *Driver) TerminateOrphanServer(orphan OrphanServer) error {
+	log.Infof("Terminating Kamatera server %s (%s)", orphan.Server.Name, orphan.Server.Id)
+	return d.serverDriver(orphan.Server).terminateServer()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	"gopkg.in/resty.v1"
+)
+
+// KamateraServerNetwork is a network interface of a Kamatera server
+type KamateraServerNetwork struct {
+	Network string `json:"network"`
+	Ips []string `json:"ips"`
+}
+
+// KamateraServerInfo are the live details of a Kamatera server
+type KamateraServerInfo struct {
+	Id string `json:"id"`
+	Name string `json:"name"`
+	Datacenter string `json:"datacenter"`
+	Power string `json:"power"`
+	Cpu string `json:"cpu"`
+	Ram int `json:"ram"`
+	DiskSizes []int `json:"diskSizes"`
+	Networks []KamateraServerNetwork `json:"networks"`
+	Billing string `json:"billing"`
+	Backup interface{} `json:"backup"`
+	Managed interface{} `json:"managed"`
+	Uptime interface{} `json:"uptime"`
+	Created string `json:"created"`
+	PriceHourlyOn interface{} `json:"priceHourlyOn"`
+	PriceMonthlyOn interface{} `json:"priceMonthlyOn"`
+	Tags []string `json:"tags"`
+}
+
+// MachineInfo is the persisted machine config merged with the live server details, secrets
+// (API credentials, scripts, user-data and keys) are omitted
+type MachineInfo struct {
+	MachineName string `json:"machineName"`
+	ServerName string `json:"serverName"`
+	KamateraServerId string `json:"kamateraServerId"`
+	Datacenter string `json:"datacenter"`
+	DatacenterName string `json:"datacenterName"`
+	Cpu string `json:"cpu"`
+	Ram int `json:"ram"`
+	DiskSize int `json:"diskSize"`
+	ExtraDiskSizes []int `json:"extraDiskSizes"`
+	ExtraDiskMounts string `json:"extraDiskMounts,omitempty"`
+	Image string `json:"image"`
+	DiskImageId string `json:"diskImageId"`
+	Billing string `json:"billing"`
+	TrafficDescription string `json:"trafficDescription,omitempty"`
+	Backup bool `json:"backup"`
+	Managed bool `json:"managed"`
+	CreateServerCommandId int `json:"createServerCommandId"`
+	IPAddress string `json:"ipAddress"`
+	PrivateNetworkName string `json:"privateNetworkName,omitempty"`
+	PrivateNetworkIp string `json:"privateNetworkIp,omitempty"`
+	SSHUser string `json:"sshUser"`
+	SSHPort int `json:"sshPort"`
+	SSHHostKey string `json:"sshHostKey,omitempty"`
+	ConfigEncryption string `json:"configEncryption,omitempty"`
+	Server *KamateraServerInfo `json:"server"`
+	ServerError string `json:"serverError,omitempty"`
+}
+
+// getServerInfo returns the live details of the Kamatera server
+func (d *Driver) getServerInfo() (*KamateraServerInfo, error) {
+	serverId, err := d.getKamateraServerId()
+	if err != nil {return nil, errors.Wrap(err, "Failed to get server id")}
+	resp, err := d.apiCall("server info", func(req *resty.Request) (*resty.Response, error) {
+		return req.Get(fmt.Sprintf("https://console.kamatera.com/service/server/%s", serverId))
+	})
+	if err != nil {return nil, err}
+	var info KamateraServerInfo
+	if err := json.Unmarshal(resp.Body(), &info); err != nil {
+		return nil, errors.Wrap(err, "Invalid JSON response from Kamatera server info")
+	}
+	return &info, nil
+}
+
+// Info returns the machine info, if the live server details can't be fetched only the
+// persisted config is returned with the error
+func (d *Driver) Info() *MachineInfo {
+	info := &MachineInfo{
+		MachineName: d.MachineName,
+		ServerName: d.ServerName,
+		KamateraServerId: d.KamateraServerId,
+		Datacenter: d.Datacenter,
+		DatacenterName: d.DatacenterName,
+		Cpu: d.Cpu,
+		Ram: d.Ram,
+		DiskSize: d.DiskSize,
+		ExtraDiskSizes: d.ExtraDiskSizesInt,
+		ExtraDiskMounts: d.ExtraDiskMounts,
+		Image: d.Image,
+		DiskImageId: d.DiskImageId,
+		Billing: d.Billing,
+		TrafficDescription: d.TrafficDescription,
+		Backup: d.Backup,
+		Managed: d.Managed,
+		CreateServerCommandId: d.CreateServerCommandId,
+		IPAddress: d.IPAddress,
+		PrivateNetworkName: d.PrivateNetworkName,
+		PrivateNetworkIp: d.PrivateNetworkIp,
+		SSHUser: d.GetSSHUsername(),
+		SSHPort: d.SSHPort,
+		SSHHostKey: d.SSHHostKey,
+		ConfigEncryption: d.ConfigEncryption,
+	}
+	server, err := d.getServerInfo()
+	if err != nil {
+		log.Warnf("Failed to get Kamatera server details: %s", err)
+		info.ServerError = err.Error()
+	} else {
+		info.Server = server
+		info.KamateraServerId = d.KamateraServerId
+	}
+	return info
+}
+
+func formatValue(value interface{}) string {
+	if value == nil {return ""}
+	return fmt.Sprintf("%v", value)
+}
+
+// WriteTable writes the machine info as a two columns table
+func (info *MachineInfo) WriteTable(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	rows := [][2]string{
+		{"Machine name", info.MachineName},
+		{"Server name", info.ServerName},
+		{"Server ID", info.KamateraServerId},
+		{"Datacenter", fmt.Sprintf("%s (%s)", info.Datacenter, info.DatacenterName)},
+		{"CPU", info.Cpu},
+		{"RAM (MB)", fmt.Sprintf("%d", info.Ram)},
+		{"Disk size (GB)", fmt.Sprintf("%d", info.DiskSize)},
+		{"Extra disk sizes (GB)", formatValue(info.ExtraDiskSizes)},
+		{"Extra disk mounts", info.ExtraDiskMounts},
+		{"Image", fmt.Sprintf("%s (%s)", info.Image, info.DiskImageId)},
+		{"Billing", info.Billing},
+		{"Traffic", info.TrafficDescription},
+		{"Backup", fmt.Sprintf("%v", info.Backup)},
+		{"Managed", fmt.Sprintf("%v", info.Managed)},
+		{"Create command ID", fmt.Sprintf("%d", info.CreateServerCommandId)},
+		{"IP address", info.IPAddress},
+		{"Private network", strings.TrimSpace(info.PrivateNetworkName + " " + info.PrivateNetworkIp)},
+		{"SSH", fmt.Sprintf("%s@%s:%d", info.SSHUser, info.IPAddress, info.SSHPort)},
+		{"Config encryption", info.ConfigEncryption},
+	}
+	if info.Server != nil {
+		rows = append(rows,
+			[2]string{"Power", info.Server.Power},
+			[2]string{"Uptime", formatValue(info.Server.Uptime)},
+			[2]string{"Live CPU", info.Server.Cpu},
+			[2]string{"Live RAM (MB)", fmt.Sprintf("%d", info.Server.Ram)},
+			[2]string{"Live disk sizes (GB)", formatValue(info.Server.DiskSizes)},
+			[2]string{"Tags", strings.Join(info.Server.Tags, ", ")},
+		)
+		for _, network := range info.Server.Networks {
+			rows = append(rows, [2]string{"NIC " + network.Network, strings.Join(network.Ips, ", ")})
+		}
+	} else {
+		rows = append(rows, [2]string{"Server details", "unavailable: " + info.ServerError})
+	}
+	for _, row := range rows {
+		if row[1] == "" {continue}
+		fmt.Fprintf(w, "%s:\t%s\n", row[0], row[1])
+	}
+	return w.Flush()
+}
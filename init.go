@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// how long to wait for the startup script and cloud-init to complete (see --kamatera-wait-for-init)
+const initWaitTimeout = 30 * time.Minute
+
+const (
+	startupScriptLogFile = "/var/lib/kamatera-machine/startup-script.log"
+	startupScriptExitFile = "/var/lib/kamatera-machine/startup-script.exit"
+	cloudInitLogFile = "/var/log/cloud-init-output.log"
+)
+
+// prints the startup script exit code once it completed, nothing while it's running
+const startupScriptStatusCmd = `cat ` + startupScriptExitFile + ` 2>/dev/null || true`
+
+// waits a few seconds for cloud-init and prints its exit code once it completed, nothing while
+// it's running, servers without cloud-init are considered completed
+const cloudInitStatusCmd = `if ! command -v cloud-init >/dev/null 2>&1; then echo 0; exit 0; fi; ` +
+	`timeout 5 cloud-init status --wait >/dev/null 2>&1; rc=$?; [ $rc -eq 124 ] || echo $rc`
+
+// waitForInit waits for the startup script and for cloud-init (if user-data was provided)
+// to complete, their logs are streamed to the driver output while waiting
+func (d *Driver) waitForInit(client *ssh.Client) error {
+	deadline := time.Now().Add(initWaitTimeout)
+	if d.StartupScript != "" {
+		exitCode, err := d.waitForInitStep(client, "startup script", startupScriptStatusCmd, startupScriptLogFile, deadline)
+		if err != nil {return err}
+		if exitCode != 0 {
+			return errors.Errorf("Startup script failed with exit code %d, see %s on the server", exitCode, startupScriptLogFile)
+		}
+	}
+	if d.UserData != "" {
+		exitCode, err := d.waitForInitStep(client, "cloud-init", cloudInitStatusCmd, cloudInitLogFile, deadline)
+		if err != nil {return err}
+		if exitCode == 2 {
+			log.Warnf("cloud-init completed with recoverable errors, see %s on the server", cloudInitLogFile)
+		} else if exitCode != 0 {
+			return errors.Errorf("cloud-init failed with exit code %d, see %s on the server", exitCode, cloudInitLogFile)
+		}
+	}
+	return nil
+}
+
+// waitForInitStep polls statusCmd until it prints an exit code, new lines of logFile are
+// logged on every poll
+func (d *Driver) waitForInitStep(client *ssh.Client, name string, statusCmd string, logFile string, deadline time.Time) (int, error) {
+	log.Infof("Waiting for %s to complete...", name)
+	logLines := 0
+	for {
+		out, _ := runSSHCommand(client, fmt.Sprintf("tail -n +%d %s 2>/dev/null || true", logLines + 1, logFile))
+		if out = strings.TrimRight(out, "\n"); out != "" {
+			for _, line := range strings.Split(out, "\n") {
+				log.Infof("[%s] %s", name, line)
+				logLines++
+			}
+		}
+		status, err := runSSHCommand(client, statusCmd)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed to get %s status", name)
+		}
+		if status = strings.TrimSpace(status); status != "" {
+			exitCode, err := strconv.Atoi(status)
+			if err != nil {
+				return 0, errors.Errorf("Invalid %s exit code: %s", name, status)
+			}
+			log.Debugf("%s completed with exit code %d", name, exitCode)
+			return exitCode, nil
+		}
+		if time.Now().After(deadline) {
+			return 0, errors.Errorf("Timed out waiting for %s to complete", name)
+		}
+		if err := d.sleep(5 * time.Second); err != nil {return 0, err}
+	}
+}
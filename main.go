@@ -18,5 +18,12 @@ func main() {
 		fmt.Printf("Version: %s\n", Version)
 		os.Exit(0)
 	}
+	if flag.NArg() > 0 {
+		if err := RunCommand(flag.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	plugin.RegisterDriver(NewDriver())
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	osFamilyDebian = "debian"
+	osFamilyRHEL = "rhel"
+	osFamilyFlatcar = "flatcar"
+	osFamilyOther = "other"
+)
+
+// os-release IDs of the operating systems docker-machine has provisioners for
+var dockerMachineSupportedOSIds = []string{
+	"arch", "boot2docker", "centos", "coreos", "debian", "fedora", "ol", "rancheros", "rhel", "suse", "ubuntu",
+}
+
+// Kamatera image name prefixes and the os-release ID of their operating system
+var imageOSIds = [][2]string{
+	{"ubuntu", "ubuntu"},
+	{"debian", "debian"},
+	{"centos", "centos"},
+	{"rockylinux", "rocky"},
+	{"rocky", "rocky"},
+	{"almalinux", "almalinux"},
+	{"redhat", "rhel"},
+	{"rhel", "rhel"},
+	{"fedora", "fedora"},
+	{"oraclelinux", "ol"},
+	{"opensuse", "opensuse-leap"},
+	{"suse", "suse"},
+	{"archlinux", "arch"},
+	{"flatcar", "flatcar"},
+	{"coreos", "coreos"},
+	{"freebsd", "freebsd"},
+	{"windows", "windows"},
+}
+
+// ImageOSId returns the os-release ID of a Kamatera image based on its name, or empty string if unknown
+func ImageOSId(image string) string {
+	image = strings.ToLower(image)
+	for _, imageOSId := range imageOSIds {
+		if strings.HasPrefix(image, imageOSId[0]) {
+			return imageOSId[1]
+		}
+	}
+	return ""
+}
+
+// validateImageOS checks the selected image can be initialized by the driver and provisioned by docker-machine
+func (d *Driver) validateImageOS() error {
+	osId := ImageOSId(d.Image)
+	switch {
+	case osId == "":
+		log.Warnf("Unknown operating system for image %s, docker-machine provisioning may fail", d.Image)
+	case osId == "windows" || osId == "freebsd":
+		return errors.Errorf("Unsupported image %s: only Linux images are supported", d.Image)
+	case ! IsStringInArray(osId, dockerMachineSupportedOSIds):
+		log.Warnf("docker-machine has no provisioner for image %s (%s), the server will be created but " +
+			"provisioning Docker will fail, use an image based on %s or use the server with --engine-install-url / manual setup",
+			d.Image, osId, strings.Join(dockerMachineSupportedOSIds, ", "))
+	}
+	return nil
+}
+
+// ServerOS is the operating system of the server as detected from /etc/os-release
+type ServerOS struct {
+	ID string
+	IDLike []string
+	Family string
+}
+
+// ParseOsRelease parses the contents of /etc/os-release
+func ParseOsRelease(content string) map[string]string {
+	values := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {continue}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {continue}
+		values[parts[0]] = strings.Trim(parts[1], `"'`)
+	}
+	return values
+}
+
+// NewServerOS returns the server operating system and its family from the os-release values
+func NewServerOS(osRelease map[string]string) *ServerOS {
+	o := &ServerOS{ID: osRelease["ID"], IDLike: strings.Fields(osRelease["ID_LIKE"]), Family: osFamilyOther}
+	for _, id := range append([]string{o.ID}, o.IDLike...) {
+		switch id {
+		case "debian", "ubuntu":
+			o.Family = osFamilyDebian
+		case "rhel", "centos", "fedora":
+			o.Family = osFamilyRHEL
+		case "flatcar", "coreos":
+			o.Family = osFamilyFlatcar
+		}
+		if o.Family != osFamilyOther {break}
+	}
+	return o
+}
+
+func detectServerOS(client *ssh.Client) (*ServerOS, error) {
+	out, err := runSSHCommand(client, "cat /etc/os-release")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to detect the Kamatera server operating system")
+	}
+	o := NewServerOS(ParseOsRelease(out))
+	log.Debugf("Server OS: %s (family %s)", o.ID, o.Family)
+	if o.Family == osFamilyOther {
+		log.Warnf("Unknown server operating system %s, using generic initialization", o.ID)
+	}
+	return o, nil
+}
+
+// ensureSudoCmd installs sudo if it's missing (e.g. minimal Debian images)
+func (o *ServerOS) ensureSudoCmd() string {
+	switch o.Family {
+	case osFamilyDebian:
+		return `command -v sudo >/dev/null || (apt-get update -q && DEBIAN_FRONTEND=noninteractive apt-get install -qy sudo)`
+	case osFamilyRHEL:
+		return `command -v sudo >/dev/null || dnf install -qy sudo || yum install -qy sudo`
+	default:
+		return `command -v sudo >/dev/null`
+	}
+}
+
+// sshdReloadCmd applies sshd config changes, on Flatcar sshd is socket activated per connection so
+// changes apply to new connections without reload
+func (o *ServerOS) sshdReloadCmd() string {
+	switch o.Family {
+	case osFamilyDebian:
+		return `systemctl reload ssh 2>/dev/null || systemctl reload sshd 2>/dev/null || service ssh reload`
+	case osFamilyRHEL:
+		return `systemctl reload sshd`
+	case osFamilyFlatcar:
+		return `true`
+	default:
+		return sshdReloadCmd
+	}
+}
+
+// sshdConfigCmd sets an sshd_config option, on Flatcar sshd_config is a symlink to a read-only
+// file which is replaced with a copy first
+func (o *ServerOS) sshdConfigCmd(option string, value string) string {
+	cmd := fmt.Sprintf(sshdConfigCmdTemplate, option, value, o.sshdReloadCmd())
+	if o.Family == osFamilyFlatcar {
+		cmd = `if [ -L /etc/ssh/sshd_config ]; then cp --remove-destination "$(readlink -f /etc/ssh/sshd_config)" /etc/ssh/sshd_config; fi; ` + cmd
+	}
+	return cmd
+}
+
+// sshPortCmd changes the SSH port, on RHEL based systems SELinux and firewalld must allow the port,
+// on Flatcar the port is configured on the sshd socket
+func (o *ServerOS) sshPortCmd(port int) string {
+	switch o.Family {
+	case osFamilyFlatcar:
+		return fmt.Sprintf(`mkdir -p /etc/systemd/system/sshd.socket.d && ` +
+			`printf '[Socket]\nListenStream=\nListenStream=%d\n' > /etc/systemd/system/sshd.socket.d/10-docker-machine-port.conf && ` +
+			`systemctl daemon-reload && systemctl restart sshd.socket`, port)
+	case osFamilyRHEL:
+		return fmt.Sprintf(`if command -v semanage >/dev/null && [ "$(getenforce 2>/dev/null)" != "Disabled" ]; then ` +
+			`semanage port -a -t ssh_port_t -p tcp %[1]d 2>/dev/null || semanage port -m -t ssh_port_t -p tcp %[1]d; fi; ` +
+			`if systemctl is-active firewalld >/dev/null 2>&1; then firewall-cmd -q --permanent --add-port=%[1]d/tcp && firewall-cmd -q --reload; fi; `,
+			port) + o.sshdConfigCmd("Port", fmt.Sprintf("%d", port))
+	default:
+		return o.sshdConfigCmd("Port", fmt.Sprintf("%d", port)) + "; " + disableSSHSocketActivationCmd
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+const redactedValue = "***"
+
+var (
+	privateKeyPattern = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)
+	publicKeyPattern = regexp.MustCompile(`((?:ssh-rsa|ssh-dss|ssh-ed25519|ecdsa-sha2-nistp[0-9]+) )AAAA[0-9A-Za-z+/]+=*`)
+	jsonSecretPattern = regexp.MustCompile(`(?i)("(?:password|passwordValidate|secret|authSecret|apiSecret)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	passwordLinePattern = regexp.MustCompile(`(?i)(password\s*[:=]\s*)[^\s"]+`)
+)
+
+// redact masks passwords, API secrets and SSH keys in s before it is logged, with
+// --kamatera-redact-scripts the startup script and user-data contents are masked as well
+func (d *Driver) redact(s string) string {
+	secrets := []string{d.APISecret, d.apiSecret}
+	if d.RedactScripts {
+		secrets = append(secrets, d.StartupScript, d.UserData)
+	}
+	for _, secret := range secrets {
+		if strings.TrimSpace(secret) != "" {
+			s = strings.Replace(s, secret, redactedValue, -1)
+		}
+	}
+	s = privateKeyPattern.ReplaceAllString(s, redactedValue)
+	s = publicKeyPattern.ReplaceAllString(s, "${1}" + redactedValue)
+	s = jsonSecretPattern.ReplaceAllString(s, `${1}"` + redactedValue + `"`)
+	s = passwordLinePattern.ReplaceAllString(s, "${1}" + redactedValue)
+	return s
+}
+
+// redactPostValues returns the create server request as JSON with secrets masked for logging
+func (d *Driver) redactPostValues(postValues CreateServerPostValues) string {
+	postValues.Password = redactedValue
+	postValues.PasswordValidate = redactedValue
+	postValues.SelectedSSHKeyValue = d.redact(postValues.SelectedSSHKeyValue)
+	if d.RedactScripts {
+		postValues.Script = redactedValue
+		postValues.UserData = redactedValue
+	} else {
+		postValues.Script = d.redact(postValues.Script)
+		postValues.UserData = d.redact(postValues.UserData)
+	}
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(postValues); err != nil {
+		return redactedValue
+	}
+	return strings.TrimSpace(buf.String())
+}
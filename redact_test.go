@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func generatePublicKey(t *testing.T) string {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {t.Fatal(err)}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {t.Fatal(err)}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey))) + " docker-machine"
+}
+
+// keyBody returns the base64 part of an authorized_keys line
+func keyBody(publicKey string) string {
+	return strings.Fields(publicKey)[1]
+}
+
+func assertRedacted(t *testing.T, output string, secrets ...string) {
+	t.Helper()
+	for _, secret := range secrets {
+		if strings.Contains(output, secret) {
+			t.Errorf("output contains secret %q: %s", secret, output)
+		}
+	}
+}
+
+func newRedactDriver() *Driver {
+	d := NewDriver()
+	d.APIClientID = "client-id"
+	d.APISecret = "api-secret-value"
+	return d
+}
+
+func TestRedactRequestJSON(t *testing.T) {
+	d := newRedactDriver()
+	output := d.redact(`{"datacenter":"EU","password":"root-pass-1","passwordValidate":"root-pass-2","apiSecret":"other-secret","AuthSecret":"auth-secret"}`)
+	assertRedacted(t, output, "root-pass-1", "root-pass-2", "other-secret", "auth-secret")
+	if ! strings.Contains(output, `"datacenter":"EU"`) {
+		t.Errorf("redacted too much: %s", output)
+	}
+	var values map[string]string
+	if err := json.Unmarshal([]byte(output), &values); err != nil {
+		t.Fatalf("redacted JSON is invalid: %s", err)
+	}
+}
+
+func TestRedactAPISecret(t *testing.T) {
+	d := newRedactDriver()
+	assertRedacted(t, d.redact("AuthClientId: client-id AuthSecret: api-secret-value"), "api-secret-value")
+	assertRedacted(t, d.redact(`{"APISecret":"api-secret-value"}`), "api-secret-value")
+	// credentials loaded from a profile or a credential helper
+	d = NewDriver()
+	d.apiClientID = "client-id"
+	d.apiSecret = "profile-secret-value"
+	assertRedacted(t, d.redact("request failed for secret profile-secret-value"), "profile-secret-value")
+}
+
+func TestRedactCreateCommandLog(t *testing.T) {
+	d := newRedactDriver()
+	createServerLog := "Creating server\nServer root password: Xy7!pass9 \nPassword=Other8pass\nServer IP: 185.1.2.3 \n"
+	output := d.redact(createServerLog)
+	assertRedacted(t, output, "Xy7!pass9", "Other8pass")
+	if ! strings.Contains(output, "185.1.2.3") {
+		t.Errorf("redacted the server IP: %s", output)
+	}
+}
+
+func TestRedactPostValues(t *testing.T) {
+	d := newRedactDriver()
+	hostKeyPEM, err := d.generateSSHHostKey()
+	if err != nil {t.Fatal(err)}
+	publicKey := generatePublicKey(t)
+	postValues := CreateServerPostValues{
+		Datacenter: "EU",
+		Password: "root-pass-1",
+		PasswordValidate: "root-pass-1",
+		Script: d.startupScriptWithHostKey(hostKeyPEM, "echo user-script"),
+		SelectedSSHKeyValue: publicKey,
+		UserData: "#cloud-config\npassword: user-data-pass\n",
+	}
+	output := d.redactPostValues(postValues)
+	hostKeyLines := strings.Split(strings.TrimSpace(hostKeyPEM), "\n")
+	assertRedacted(t, output, "root-pass-1", "user-data-pass", keyBody(publicKey))
+	for _, line := range hostKeyLines[1:len(hostKeyLines) - 1] {
+		assertRedacted(t, output, line)
+	}
+	if ! strings.Contains(output, "echo user-script") {
+		t.Errorf("startup script should only be masked with --%s: %s", flagRedactScripts, output)
+	}
+	if postValues.Password != "root-pass-1" || postValues.SelectedSSHKeyValue != publicKey {
+		t.Errorf("redactPostValues modified the request")
+	}
+}
+
+func TestRedactScripts(t *testing.T) {
+	d := newRedactDriver()
+	d.RedactScripts = true
+	d.StartupScript = "#!/bin/sh\necho script-token-value\n"
+	d.UserData = "#cloud-config\nruncmd: [echo userdata-token-value]\n"
+	assertRedacted(t, d.redact("running " + d.StartupScript + " with " + d.UserData), "script-token-value", "userdata-token-value")
+	hostKeyPEM, err := d.generateSSHHostKey()
+	if err != nil {t.Fatal(err)}
+	output := d.redactPostValues(CreateServerPostValues{
+		Script: d.startupScriptWithHostKey(hostKeyPEM, d.StartupScript),
+		UserData: d.UserData,
+	})
+	assertRedacted(t, output, "script-token-value", "userdata-token-value", "PRIVATE KEY")
+	var values CreateServerPostValues
+	if err := json.Unmarshal([]byte(output), &values); err != nil {t.Fatal(err)}
+	if values.Script != redactedValue || values.UserData != redactedValue {
+		t.Errorf("expected masked scripts, got %+v", values)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	"gopkg.in/resty.v1"
+)
+
+// grows the partition and filesystem mounted on the given target to the size of its disk,
+// filesystems on LVM or without a partition table are skipped
+const growFilesystemScriptTemplate = `set -e
+target=%s
+src=$(findmnt -nvo SOURCE "$target"); fstype=$(findmnt -nvo FSTYPE "$target")
+name=$(basename "$src")
+if [ ! -f "/sys/class/block/$name/partition" ]; then echo "$src is not a partition, skipping"; exit 0; fi
+partnum=$(cat "/sys/class/block/$name/partition")
+disk=/dev/$(lsblk -no PKNAME "$src" | head -1)
+if command -v growpart >/dev/null; then
+  growpart "$disk" "$partnum" || [ $? -eq 1 ]
+else
+  echo ", +" | sfdisk -q -N "$partnum" --no-reread "$disk"
+  partx -u "$disk" 2>/dev/null || partprobe "$disk"
+fi
+case "$fstype" in
+  ext*) resize2fs "$src" ;;
+  xfs) xfs_growfs "$target" ;;
+  *) echo "unsupported filesystem $fstype on $target, skipping"
+esac
+`
+
+// ResizeOptions are the changes to apply to an existing machine, zero values are left unchanged
+type ResizeOptions struct {
+	Cpu string
+	Ram int
+	// new sizes in GB by disk index, 0 is the primary disk and 1-3 are the extra disks
+	DiskSizes map[int]int
+	// grow the filesystems on the resized disks over SSH
+	GrowFilesystem bool
+}
+
+// ParseDiskSizes parses comma-separated INDEX=SIZE disk sizes
+func ParseDiskSizes(value string) (map[int]int, error) {
+	diskSizes := map[int]int{}
+	for _, diskSizeStr := range strings.Split(value, ",") {
+		diskSizeStr = strings.TrimSpace(diskSizeStr)
+		if diskSizeStr == "" {continue}
+		parts := strings.SplitN(diskSizeStr, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid disk size: '%s', expected INDEX=SIZE", diskSizeStr)
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {return nil, errors.Errorf("Invalid disk index: '%s'", parts[0])}
+		size, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {return nil, errors.Errorf("Invalid disk size: '%s'", parts[1])}
+		diskSizes[index] = size
+	}
+	return diskSizes, nil
+}
+
+// diskSize returns the size in GB of the disk with the given index (0 is the primary disk)
+func (d *Driver) diskSize(index int) int {
+	if index == 0 {return d.DiskSize}
+	return d.ExtraDiskSizesInt[index - 1]
+}
+
+func (d *Driver) setDiskSize(index int, size int) {
+	if index == 0 {
+		d.DiskSize = size
+		return
+	}
+	d.ExtraDiskSizesInt[index - 1] = size
+	d.updateExtraDisks()
+}
+
+func (d *Driver) validateResize(opts ResizeOptions) error {
+	res, err := d.getServerOptions()
+	if err != nil {return err}
+	if opts.Cpu != "" && ! IsStringInArray(opts.Cpu, res.Cpu) {return errors.New("Invalid CPU")}
+	if opts.Ram != 0 && opts.Ram < 999 {return errors.New("Insufficient RAM, Please use at least 1GB of RAM.")}
+	for index, size := range opts.DiskSizes {
+		if index < 0 || index > len(d.ExtraDiskSizesInt) {
+			return errors.Errorf("Invalid disk index %d: the machine has %d extra disks", index, len(d.ExtraDiskSizesInt))
+		}
+		if ! IsIntInArray(size, res.Disk) {return errors.Errorf("Invalid disk size: %d", size)}
+		if size < d.diskSize(index) {
+			return errors.Errorf("Disk %d can't be shrunk from %dGB to %dGB", index, d.diskSize(index), size)
+		}
+	}
+	return nil
+}
+
+// configureServer runs a Kamatera server configuration operation and waits for it to complete
+func (d *Driver) configureServer(operation string, path string, formData map[string]string) error {
+	return d.serverOperation(operation, resty.MethodPut, path, formData)
+}
+
+// Resize changes the CPU / RAM and grows the disks of the Kamatera server, the server is powered
+// off for the change and powered on again if it was running
+func (d *Driver) Resize(opts ResizeOptions) (err error) {
+	if opts.Cpu == d.Cpu {opts.Cpu = ""}
+	if opts.Ram == d.Ram {opts.Ram = 0}
+	for index, size := range opts.DiskSizes {
+		if index >= 0 && index <= len(d.ExtraDiskSizesInt) && size == d.diskSize(index) {
+			delete(opts.DiskSizes, index)
+		}
+	}
+	if opts.Cpu == "" && opts.Ram == 0 && len(opts.DiskSizes) == 0 {
+		log.Infof("Nothing to resize")
+		return nil
+	}
+	if err := d.validateResize(opts); err != nil {return err}
+	if err := d.autoSnapshot("resize"); err != nil {return err}
+	power, err := d.getKamateraServerPower()
+	if err != nil {return err}
+	wasRunning := power == "on"
+	poweredOn := ! wasRunning
+	if wasRunning {
+		log.Infof("Powering off the Kamatera server for resize")
+		if err := d.kamateraPower("off"); err != nil {return err}
+		// don't leave a running server powered off if the resize fails
+		defer func() {
+			if err == nil || poweredOn {return}
+			log.Infof("Resize failed, powering on the Kamatera server")
+			if powerErr := d.kamateraPower("on"); powerErr != nil {
+				log.Warnf("Failed to power on the Kamatera server: %s", powerErr)
+			}
+		}()
+	}
+	if opts.Cpu != "" || opts.Ram != 0 {
+		formData := map[string]string{}
+		if opts.Cpu != "" {formData["cpu"] = opts.Cpu}
+		if opts.Ram != 0 {formData["ram"] = strconv.Itoa(opts.Ram)}
+		if err := d.configureServer("server configure", "configure", formData); err != nil {return err}
+		if opts.Cpu != "" {d.Cpu = opts.Cpu}
+		if opts.Ram != 0 {d.Ram = opts.Ram}
+	}
+	for index, size := range opts.DiskSizes {
+		formData := map[string]string{"action": "update", "index": strconv.Itoa(index), "size": strconv.Itoa(size)}
+		if err := d.configureServer(fmt.Sprintf("disk %d resize", index), "disk", formData); err != nil {return err}
+		d.setDiskSize(index, size)
+	}
+	if wasRunning {
+		log.Infof("Powering on the Kamatera server")
+		if err := d.kamateraPower("on"); err != nil {return err}
+		poweredOn = true
+		if opts.GrowFilesystem && len(opts.DiskSizes) > 0 {
+			return d.growFilesystems(opts.DiskSizes)
+		}
+	} else if opts.GrowFilesystem && len(opts.DiskSizes) > 0 {
+		log.Warnf("The Kamatera server is not running, filesystems were not grown")
+	}
+	return nil
+}
+
+// growFilesystems grows the root filesystem if the primary disk was resized and the filesystems
+// mounted with --kamatera-extra-disk-mounts on resized extra disks
+func (d *Driver) growFilesystems(diskSizes map[int]int) error {
+	var targets []string
+	if _, ok := diskSizes[0]; ok {targets = append(targets, "/")}
+	for _, mount := range d.ExtraDiskMountsList {
+		if _, ok := diskSizes[mount.Disk]; ok {targets = append(targets, mount.Target)}
+	}
+	if len(targets) == 0 {return nil}
+	port, err := d.GetSSHPort()
+	if err != nil {return err}
+	client, err := d.waitForSSH(d.GetSSHUsername(), port)
+	if err != nil {return err}
+	defer client.Close()
+	for _, target := range targets {
+		log.Infof("Growing filesystem %s", target)
+		script := fmt.Sprintf(growFilesystemScriptTemplate, target)
+		if _, err := runSSHCommandWithInput(client, sudoCmd(d.GetSSHUsername(), "sh -s"), script); err != nil {
+			return errors.Wrapf(err, "Failed to grow filesystem %s", target)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	"gopkg.in/resty.v1"
+)
+
+// KamateraSnapshotInfo is a snapshot of a Kamatera server
+type KamateraSnapshotInfo struct {
+	Id interface{} `json:"id"`
+	Name string `json:"name"`
+	Date string `json:"date"`
+	Current bool `json:"current"`
+}
+
+func (s *KamateraSnapshotInfo) id() string {
+	return fmt.Sprintf("%v", s.Id)
+}
+
+// ListSnapshots returns the snapshots of the Kamatera server
+func (d *Driver) ListSnapshots() ([]KamateraSnapshotInfo, error) {
+	serverId, err := d.getKamateraServerId()
+	if err != nil {return nil, errors.Wrap(err, "Failed to get server id")}
+	resp, err := d.apiCall("list snapshots", func(req *resty.Request) (*resty.Response, error) {
+		return req.Get(fmt.Sprintf("https://console.kamatera.com/service/server/%s/snapshots", serverId))
+	})
+	if err != nil {return nil, err}
+	var snapshots []KamateraSnapshotInfo
+	if err := json.Unmarshal(resp.Body(), &snapshots); err != nil {
+		return nil, errors.Wrap(err, "Invalid JSON response from Kamatera list snapshots")
+	}
+	return snapshots, nil
+}
+
+// findSnapshot returns the snapshot with the given name or ID
+func (d *Driver) findSnapshot(nameOrId string) (*KamateraSnapshotInfo, error) {
+	snapshots, err := d.ListSnapshots()
+	if err != nil {return nil, err}
+	for _, snapshot := range snapshots {
+		if snapshot.Name == nameOrId || snapshot.id() == nameOrId {
+			return &snapshot, nil
+		}
+	}
+	return nil, errors.Errorf("Snapshot '%s' not found for Kamatera server %s", nameOrId, d.ServerName)
+}
+
+// CreateSnapshot creates a snapshot of the Kamatera server
+func (d *Driver) CreateSnapshot(name string) error {
+	if name == "" {return errors.New("Snapshot name is required")}
+	log.Infof("Creating snapshot %s of Kamatera server %s", name, d.ServerName)
+	return d.serverOperation("snapshot create", resty.MethodPost, "snapshot", map[string]string{"name": name})
+}
+
+// RevertSnapshot reverts the Kamatera server to the snapshot with the given name or ID
+func (d *Driver) RevertSnapshot(nameOrId string) error {
+	snapshot, err := d.findSnapshot(nameOrId)
+	if err != nil {return err}
+	log.Infof("Reverting Kamatera server %s to snapshot %s", d.ServerName, snapshot.Name)
+	return d.serverOperation("snapshot revert", resty.MethodPut, fmt.Sprintf("snapshot/%s/revert", snapshot.id()), nil)
+}
+
+// DeleteSnapshot deletes the snapshot with the given name or ID
+func (d *Driver) DeleteSnapshot(nameOrId string) error {
+	snapshot, err := d.findSnapshot(nameOrId)
+	if err != nil {return err}
+	log.Infof("Deleting snapshot %s of Kamatera server %s", snapshot.Name, d.ServerName)
+	return d.serverOperation("snapshot delete", resty.MethodDelete, fmt.Sprintf("snapshot/%s", snapshot.id()), nil)
+}
+
+// autoSnapshot creates a snapshot before a destructive operation if --kamatera-auto-snapshot is set
+func (d *Driver) autoSnapshot(operation string) error {
+	if ! d.AutoSnapshot {return nil}
+	name := fmt.Sprintf("before-%s-%s", operation, time.Now().UTC().Format("20060102-150405"))
+	if err := d.CreateSnapshot(name); err != nil {
+		return errors.Wrapf(err, "Failed to create snapshot before %s", operation)
+	}
+	return nil
+}
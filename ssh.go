@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+	mcnssh "github.com/docker/machine/libmachine/ssh"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// how long to wait for the server to accept SSH connections after creation
+const sshWaitTimeout = 10 * time.Minute
+
+// sets an sshd_config option (in the main config and in any included config files) and reloads sshd
+// using the given OS specific command
+const sshdConfigCmdTemplate = `for f in /etc/ssh/sshd_config /etc/ssh/sshd_config.d/*.conf; do ` +
+	`[ -f "$f" ] && sed -i -e 's/^[#[:space:]]*%[1]s[[:space:]].*$/%[1]s %[2]s/' "$f"; done; ` +
+	`grep -q '^%[1]s %[2]s' /etc/ssh/sshd_config || echo '%[1]s %[2]s' >> /etc/ssh/sshd_config; %[3]s`
+
+// reloads sshd on unknown operating systems
+const sshdReloadCmd = `systemctl reload sshd 2>/dev/null || systemctl reload ssh 2>/dev/null || service ssh reload 2>/dev/null || service sshd reload`
+
+// creates a sudo-enabled user, SSH keys are installed for it using installAuthorizedKeysScript
+const createSSHUserCmdTemplate = `set -e; ` +
+	`id -u %[1]s >/dev/null 2>&1 || useradd -m -s "$(command -v bash || echo /bin/sh)" %[1]s; ` +
+	`mkdir -p /etc/sudoers.d; ` +
+	`echo '%[1]s ALL=(ALL) NOPASSWD:ALL' > /etc/sudoers.d/90-docker-machine-%[1]s; ` +
+	`chmod 440 /etc/sudoers.d/90-docker-machine-%[1]s`
+
+// POSIX sh script which appends the public keys read from stdin (one per line) to the
+// authorized_keys of the user given as first argument, skipping keys which already exist
+const installAuthorizedKeysScript = `set -e
+user="$1"
+home=$(getent passwd "$user" | cut -d: -f6)
+group=$(id -gn "$user")
+[ -n "$home" ] || { echo "Failed to find the home directory of $user" >&2; exit 1; }
+[ -n "$group" ] || { echo "Failed to find the group of $user" >&2; exit 1; }
+umask 077
+mkdir -p "$home/.ssh"
+file="$home/.ssh/authorized_keys"
+touch "$file"
+if [ -s "$file" ] && [ -n "$(tail -c 1 "$file")" ]; then echo >> "$file"; fi
+while IFS= read -r key; do
+  [ -n "$key" ] || continue
+  grep -qxF "$key" "$file" || printf "%s\n" "$key" >> "$file"
+done
+chown "$user:$group" "$home/.ssh" "$file"
+chmod 700 "$home/.ssh"
+chmod 600 "$file"
+`
+
+// matches user names which are safe to use in shell commands
+var sshUserPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// with systemd socket activation sshd doesn't bind the configured port, switch to the ssh service
+const disableSSHSocketActivationCmd = `if systemctl is-enabled ssh.socket >/dev/null 2>&1; then ` +
+	`systemctl disable --now ssh.socket && systemctl enable ssh.service && systemctl restart ssh.service; fi`
+
+// the initial connection is made to the default port before the driver reconfigures sshd
+const defaultSSHPort = 22
+
+func createSSHUserCmd(user string) string {
+	return fmt.Sprintf(createSSHUserCmdTemplate, user)
+}
+
+// the startup script sent to Kamatera is wrapped with this prelude which installs the pinned
+// host key generated by the driver, the user's startup script (if any) runs after it
+const startupScriptHostKeyTemplate = `#!/bin/sh
+# SSH host key pinned by docker-machine-driver-kamatera
+umask 077
+cat > /etc/ssh/ssh_host_ecdsa_key <<'KAMATERA_SSH_HOST_KEY'
+%sKAMATERA_SSH_HOST_KEY
+echo '%s' > /etc/ssh/ssh_host_ecdsa_key.pub
+chmod 644 /etc/ssh/ssh_host_ecdsa_key.pub
+if systemctl is-enabled sshd.socket >/dev/null 2>&1; then :; else systemctl restart sshd 2>/dev/null || systemctl restart ssh 2>/dev/null || service ssh restart 2>/dev/null || service sshd restart; fi
+`
+
+// the user's startup script runs with its output logged, its exit code is written to a marker
+// file when it completes so the driver can wait for it (see --kamatera-wait-for-init)
+const startupScriptUserScriptTemplate = `mkdir -p /var/lib/kamatera-machine
+cat > /var/lib/kamatera-machine/startup-script <<'KAMATERA_STARTUP_SCRIPT'
+%s
+KAMATERA_STARTUP_SCRIPT
+chmod 700 /var/lib/kamatera-machine/startup-script
+/var/lib/kamatera-machine/startup-script > ` + startupScriptLogFile + ` 2>&1
+echo $? > ` + startupScriptExitFile + `.tmp
+mv ` + startupScriptExitFile + `.tmp ` + startupScriptExitFile + `
+`
+
+// prepareSSHKey copies the key from --kamatera-ssh-key-path or generates the machine SSH key
+// (if it doesn't exist yet) and returns the public key
+func (d *Driver) prepareSSHKey() (string, error) {
+	if d.ExistingSSHKeyPath != "" {
+		log.Debugf("Copying SSH key %s", d.ExistingSSHKeyPath)
+		if err := mcnutils.CopyFile(d.ExistingSSHKeyPath, d.GetSSHKeyPath()); err != nil {
+			return "", errors.Wrap(err, "could not copy ssh key")
+		}
+		if err := os.Chmod(d.GetSSHKeyPath(), 0600); err != nil {
+			return "", errors.Wrap(err, "could not set ssh key permissions")
+		}
+		signer, err := loadSSHSigner(d.GetSSHKeyPath())
+		if err != nil {return "", err}
+		pkey := ssh.MarshalAuthorizedKey(signer.PublicKey())
+		if err := ioutil.WriteFile(d.GetSSHKeyPath() + ".pub", pkey, 0644); err != nil {
+			return "", errors.Wrap(err, "could not write ssh public key")
+		}
+		return strings.TrimSpace(string(pkey)), nil
+	}
+	log.Debugf("Generating SSH key...")
+	if err := mcnssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
+		return "", errors.Wrap(err, "could not generate ssh key")
+	}
+	buf, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
+	if err != nil {
+		return "", errors.Wrap(err, "could not read ssh public key")
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// generateSSHHostKey generates an SSH host key for the server, the public key is pinned in
+// d.SSHHostKey and the PEM encoded private key is returned to be injected on creation
+func (d *Driver) generateSSHHostKey() (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", errors.Wrap(err, "could not generate ssh host key")
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal ssh host key")
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", errors.Wrap(err, "could not get ssh host public key")
+	}
+	d.SSHHostKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})), nil
+}
+
+// startupScriptWithHostKey returns the startup script to send to Kamatera
+func (d *Driver) startupScriptWithHostKey(hostKeyPEM string, userScript string) string {
+	script := fmt.Sprintf(startupScriptHostKeyTemplate, hostKeyPEM, d.SSHHostKey)
+	if userScript != "" {
+		script += fmt.Sprintf(startupScriptUserScriptTemplate, strings.TrimRight(userScript, "\n"))
+	}
+	return script
+}
+
+// hostKeyCallback verifies the server presents the host key pinned on creation
+func (d *Driver) hostKeyCallback() (ssh.HostKeyCallback, []string, error) {
+	if d.SSHHostKey == "" {
+		log.Warnf("No pinned SSH host key for machine %s, the server host key will not be verified", d.MachineName)
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(d.SSHHostKey))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not parse pinned ssh host key")
+	}
+	return ssh.FixedHostKey(hostKey), []string{hostKey.Type()}, nil
+}
+
+func loadSSHSigner(path string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read ssh private key")
+	}
+	signer, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse ssh private key (passphrase protected keys are not supported)")
+	}
+	return signer, nil
+}
+
+func (d *Driver) sshClientConfig(user string) (*ssh.ClientConfig, error) {
+	signer, err := loadSSHSigner(d.GetSSHKeyPath())
+	if err != nil {return nil, err}
+	hostKeyCallback, hostKeyAlgorithms, err := d.hostKeyCallback()
+	if err != nil {return nil, err}
+	return &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		HostKeyCallback: hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout: 30 * time.Second,
+	}, nil
+}
+
+// waitForSSH retries connecting to the server until it accepts the machine SSH key, on creation
+// until the startup script installs the pinned host key the connection fails host key verification
+func (d *Driver) waitForSSH(user string, port int) (*ssh.Client, error) {
+	config, err := d.sshClientConfig(user)
+	if err != nil {return nil, err}
+	deadline := time.Now().Add(sshWaitTimeout)
+	for {
+		log.Debugf("Create/ssh: %s", time.Now())
+		if err := d.sleep(2 * time.Second); err != nil {return nil, err}
+		client, err := ssh.Dial("tcp", net.JoinHostPort(d.IPAddress, strconv.Itoa(port)), config)
+		if err == nil {
+			return client, nil
+		}
+		log.Debugf("SSH failure (%s): %s", time.Now(), err)
+		if time.Now().After(deadline) {
+			return nil, errors.Wrap(err, "Timed out waiting for SSH connection to the Kamatera server")
+		}
+	}
+}
+
+// dialSSH makes a single SSH connection attempt to the machine as its SSH user
+func (d *Driver) dialSSH() (*ssh.Client, error) {
+	config, err := d.sshClientConfig(d.GetSSHUsername())
+	if err != nil {return nil, err}
+	port, err := d.GetSSHPort()
+	if err != nil {return nil, err}
+	return ssh.Dial("tcp", net.JoinHostPort(d.IPAddress, strconv.Itoa(port)), config)
+}
+
+// authorizedKeys returns the machine public key followed by the extra SSH keys
+func (d *Driver) authorizedKeys() ([]string, error) {
+	buf, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read ssh public key")
+	}
+	return append([]string{strings.TrimSpace(string(buf))}, d.ExtraSshKeys...), nil
+}
+
+// installAuthorizedKeys adds the keys to the user's authorized_keys, the keys are piped
+// to the remote shell via stdin so they are never interpreted by the shell
+func installAuthorizedKeys(client *ssh.Client, user string, keys []string) error {
+	cmd := fmt.Sprintf("sh -c '%s' sh %s", installAuthorizedKeysScript, user)
+	_, err := runSSHCommandWithInput(client, cmd, strings.Join(keys, "\n") + "\n")
+	return err
+}
+
+// sudoCmd runs cmd with sudo when connected as a non-root user
+func sudoCmd(user string, cmd string) string {
+	if user == "root" {return cmd}
+	return "sudo " + cmd
+}
+
+// runSSHCommand runs cmd in a new session and returns its combined output
+func runSSHCommand(client *ssh.Client, cmd string) (string, error) {
+	return runSSHCommandWithInput(client, cmd, "")
+}
+
+func runSSHCommandWithInput(client *ssh.Client, cmd string, input string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {return "", errors.Wrap(err, "Failed to open SSH session")}
+	defer session.Close()
+	session.Stdin = strings.NewReader(input)
+	var b bytes.Buffer
+	session.Stdout = &b
+	session.Stderr = &b
+	err = session.Run(cmd)
+	if err != nil {
+		return b.String(), errors.Wrapf(err, "SSH command failed: %s", strings.TrimSpace(b.String()))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/resty.v1"
+)
+
+// ParseAuthorizedKeys parses authorized_keys formatted content, every key is validated and
+// returned normalized as a single authorized_keys line (including options and comment)
+func ParseAuthorizedKeys(content string, source string) ([]string, error) {
+	var keys []string
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {continue}
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid SSH public key in %s (line %d)", source, i + 1)
+		}
+		if len(rest) > 0 {
+			return nil, errors.Errorf("Invalid SSH public key in %s (line %d)", source, i + 1)
+		}
+		normalized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		if len(options) > 0 {
+			normalized = strings.Join(options, ",") + " " + normalized
+		}
+		if comment != "" {
+			normalized += " " + comment
+		}
+		keys = append(keys, normalized)
+	}
+	return keys, nil
+}
+
+// FetchAuthorizedKeys fetches public SSH keys from a gh:<username> or https URL source
+func FetchAuthorizedKeys(source string) (string, error) {
+	keysUrl := source
+	if strings.HasPrefix(source, "gh:") {
+		username := strings.TrimPrefix(source, "gh:")
+		if username == "" {return "", errors.Errorf("Invalid SSH keys source: %s", source)}
+		keysUrl = fmt.Sprintf("https://github.com/%s.keys", url.PathEscape(username))
+	} else if ! strings.HasPrefix(source, "https://") {
+		return "", errors.Errorf("Invalid SSH keys source, must be gh:<username> or an https URL: %s", source)
+	}
+	log.Debugf("Fetching SSH keys from %s", keysUrl)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(keysUrl)
+	if err != nil {return "", errors.Wrapf(err, "Failed to fetch SSH keys from %s", keysUrl)}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", errors.Errorf("Failed to fetch SSH keys from %s: status %d", keysUrl, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {return "", errors.Wrapf(err, "Failed to read SSH keys from %s", keysUrl)}
+	return string(body), nil
+}
+
+// loadExtraSSHKeys returns all the validated extra SSH keys from the keys, key files and key URLs flags
+func (d *Driver) loadExtraSSHKeys() ([]string, error) {
+	var keys []string
+	for i, value := range d.ExtraSshKeyStrings {
+		parsed, err := ParseAuthorizedKeys(value, fmt.Sprintf("--%s (%d)", flagExtraSshKeyString, i + 1))
+		if err != nil {return nil, err}
+		keys = append(keys, parsed...)
+	}
+	for _, path := range d.ExtraSshKeyFiles {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {return nil, errors.Wrap(err, "Failed to read extra SSH keys file")}
+		parsed, err := ParseAuthorizedKeys(string(buf), path)
+		if err != nil {return nil, err}
+		keys = append(keys, parsed...)
+	}
+	for _, source := range d.ExtraSshKeyUrls {
+		content, err := FetchAuthorizedKeys(source)
+		if err != nil {return nil, err}
+		parsed, err := ParseAuthorizedKeys(content, source)
+		if err != nil {return nil, err}
+		if len(parsed) == 0 {
+			return nil, errors.Errorf("No SSH keys found in %s", source)
+		}
+		keys = append(keys, parsed...)
+	}
+	return keys, nil
+}
+
+type KamateraSSHKeyInfo struct {
+	Id interface{} `json:"id"`
+	Name string `json:"name"`
+}
+
+func (d *Driver) listAccountSSHKeys() ([]KamateraSSHKeyInfo, error) {
+	resp, err := d.apiCall("list SSH keys", func(req *resty.Request) (*resty.Response, error) {
+		return req.Get("https://console.kamatera.com/service/sshkeys")
+	})
+	if err != nil {return nil, err}
+	var keys []KamateraSSHKeyInfo
+	if err := json.Unmarshal(resp.Body(), &keys); err != nil {
+		return nil, errors.Wrap(err, "Invalid JSON response from Kamatera list SSH keys")
+	}
+	return keys, nil
+}
+
+// findAccountSSHKeyId returns the ID of the SSH key with the given name stored in the Kamatera account
+func (d *Driver) findAccountSSHKeyId(name string) (string, error) {
+	keys, err := d.listAccountSSHKeys()
+	if err != nil {return "", err}
+	for _, key := range keys {
+		if key.Name == name {
+			return fmt.Sprintf("%v", key.Id), nil
+		}
+	}
+	return "", errors.Errorf("SSH key '%s' not found in the Kamatera account", name)
+}
+
+// uploadAccountSSHKey stores the public key in the Kamatera account and returns its ID
+func (d *Driver) uploadAccountSSHKey(name string, publicKey string) (string, error) {
+	resp, err := d.apiCall("upload SSH key", func(req *resty.Request) (*resty.Response, error) {
+		return req.SetFormData(map[string]string{"name": name, "value": publicKey}).
+			Post("https://console.kamatera.com/service/sshkey")
+	})
+	if err != nil {return "", err}
+	var key KamateraSSHKeyInfo
+	if err := json.Unmarshal(resp.Body(), &key); err != nil {
+		return "", errors.Wrap(err, "Invalid JSON response from Kamatera upload SSH key")
+	}
+	return fmt.Sprintf("%v", key.Id), nil
+}
+
+func (d *Driver) deleteAccountSSHKey(id string) error {
+	_, err := d.apiCall("delete SSH key", func(req *resty.Request) (*resty.Response, error) {
+		return req.Delete(fmt.Sprintf("https://console.kamatera.com/service/sshkey/%s", id))
+	})
+	return err
+}
+
+// removeUploadedSSHKey deletes the account SSH key uploaded on creation, failure is only logged
+// as the key doesn't grant access once the server is removed
+func (d *Driver) removeUploadedSSHKey() {
+	if d.UploadedSSHKeyId == "" {return}
+	log.Debugf("Deleting Kamatera account SSH key ID %s", d.UploadedSSHKeyId)
+	if err := d.deleteAccountSSHKey(d.UploadedSSHKeyId); err != nil && err != errKamateraNotFound {
+		log.Warnf("Failed to delete Kamatera account SSH key (key id = %s), please delete it manually: %s", d.UploadedSSHKeyId, err)
+		return
+	}
+	d.UploadedSSHKeyId = ""
+}
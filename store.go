@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/commands/mcndirs"
+	"github.com/pkg/errors"
+)
+
+// Machine is a Kamatera machine loaded from the docker-machine store, the other host
+// config fields are kept as-is so they are preserved when the machine is saved
+type Machine struct {
+	Name string
+	ConfigPath string
+	Driver *Driver
+	hostConfig map[string]json.RawMessage
+}
+
+func defaultStoragePath() string {
+	return mcndirs.GetBaseDir()
+}
+
+func machineConfigPath(storagePath string, name string) string {
+	return filepath.Join(storagePath, "machines", name, "config.json")
+}
+
+// LoadMachine loads a Kamatera machine config from the store, encrypted fields are decrypted
+func LoadMachine(storagePath string, name string) (*Machine, error) {
+	m := &Machine{Name: name, ConfigPath: machineConfigPath(storagePath, name)}
+	buf, err := ioutil.ReadFile(m.ConfigPath)
+	if err != nil {return nil, errors.Wrapf(err, "Failed to read machine config for %s", name)}
+	if err := json.Unmarshal(buf, &m.hostConfig); err != nil {
+		return nil, errors.Wrapf(err, "Invalid machine config for %s", name)
+	}
+	var driverName string
+	if err := json.Unmarshal(m.hostConfig["DriverName"], &driverName); err != nil || driverName != "kamatera" {
+		return nil, errors.Errorf("Machine %s is not a Kamatera machine", name)
+	}
+	m.Driver = NewDriver()
+	if err := json.Unmarshal(m.hostConfig["Driver"], m.Driver); err != nil {
+		return nil, errors.Wrapf(err, "Failed to load Kamatera driver config for %s", name)
+	}
+	return m, nil
+}
+
+// Save writes the machine config back to the store, replacing the file atomically
+func (m *Machine) Save() error {
+	driverConfig, err := json.Marshal(m.Driver)
+	if err != nil {return err}
+	m.hostConfig["Driver"] = driverConfig
+	buf, err := json.MarshalIndent(m.hostConfig, "", "    ")
+	if err != nil {return err}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(m.ConfigPath), "config.json.tmp")
+	if err != nil {return err}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(buf); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {return err}
+	if err := os.Chmod(tmpFile.Name(), 0600); err != nil {return err}
+	return os.Rename(tmpFile.Name(), m.ConfigPath)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	"gopkg.in/resty.v1"
+)
+
+// tags added automatically to servers created by the driver, used to find the servers
+const (
+	managedByTag = "managed-by:docker-machine-driver-kamatera"
+	machineTagPrefix = "docker-machine:"
+)
+
+func (d *Driver) machineTag() string {
+	return machineTagPrefix + d.MachineName
+}
+
+// withAutomaticTags returns the tags with the automatic tags appended
+func (d *Driver) withAutomaticTags(tags []string) []string {
+	var result []string
+	for _, tag := range append(tags, d.machineTag(), managedByTag) {
+		if ! IsStringInArray(tag, result) {result = append(result, tag)}
+	}
+	return result
+}
+
+// FindServersByTag returns the Kamatera servers which have the given tag
+func (d *Driver) FindServersByTag(tag string) ([]KamateraServerListInfo, error) {
+	servers, err := d.listServers()
+	if err != nil {return nil, err}
+	var result []KamateraServerListInfo
+	for _, server := range servers {
+		if IsStringInArray(tag, server.Tags) {result = append(result, server)}
+	}
+	return result, nil
+}
+
+// AddTag adds a tag to the Kamatera server
+func (d *Driver) AddTag(tag string) error {
+	if IsStringInArray(tag, d.Tags) {return nil}
+	log.Infof("Adding tag %s to Kamatera server %s", tag, d.ServerName)
+	if err := d.serverOperation("tag add", resty.MethodPut, "tags", map[string]string{"action": "add", "tag": tag}); err != nil {
+		return err
+	}
+	d.Tags = append(d.Tags, tag)
+	return nil
+}
+
+// RemoveTag removes a tag from the Kamatera server, the automatic tags can't be removed
+func (d *Driver) RemoveTag(tag string) error {
+	if tag == managedByTag || tag == d.machineTag() {
+		return errors.Errorf("Tag %s is used by the driver to find the server and can't be removed", tag)
+	}
+	if ! IsStringInArray(tag, d.Tags) {return nil}
+	log.Infof("Removing tag %s from Kamatera server %s", tag, d.ServerName)
+	if err := d.serverOperation("tag remove", resty.MethodPut, "tags", map[string]string{"action": "remove", "tag": tag}); err != nil {
+		return err
+	}
+	var tags []string
+	for _, t := range d.Tags {
+		if t != tag {tags = append(tags, t)}
+	}
+	d.Tags = tags
+	return nil
+}
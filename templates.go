@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// TemplateData is available in startup script and user-data templates
+type TemplateData struct {
+	MachineName string
+	ServerName string
+	Datacenter string
+	Tags []string
+	Vars map[string]string
+	privateNetworkIp string
+}
+
+// PrivateNetworkIp returns the --kamatera-private-network-ip, an automatically assigned ip is
+// only known after the server was created so using it in a template is an error
+func (t TemplateData) PrivateNetworkIp() (string, error) {
+	if t.privateNetworkIp == "auto" {
+		return "", errors.Errorf("The private network ip is assigned automatically, set --%s to use it in templates", flagPrivateNetworkIp)
+	}
+	return t.privateNetworkIp, nil
+}
+
+// templateVars parses the --kamatera-template-var key=value pairs
+func (d *Driver) templateVars() (map[string]string, error) {
+	vars := map[string]string{}
+	for _, templateVar := range d.TemplateVars {
+		parts := strings.SplitN(templateVar, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.Errorf("Invalid --%s, expected key=value: %s", flagTemplateVar, templateVar)
+		}
+		vars[strings.TrimSpace(parts[0])] = parts[1]
+	}
+	return vars, nil
+}
+
+func (d *Driver) templateData() (TemplateData, error) {
+	vars, err := d.templateVars()
+	if err != nil {return TemplateData{}, err}
+	privateNetworkIp := ""
+	if d.PrivateNetworkName != "" {
+		privateNetworkIp = d.GetPrivateNetworkIp()
+	}
+	return TemplateData{
+		MachineName: d.MachineName,
+		ServerName: d.ServerName,
+		Datacenter: d.Datacenter,
+		Tags: d.Tags,
+		Vars: vars,
+		privateNetworkIp: privateNetworkIp,
+	}, nil
+}
+
+// RenderTemplate renders text as a Go template, referencing a missing template var is an error
+func RenderTemplate(name string, text string, data TemplateData) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {return "", errors.Wrapf(err, "Failed to parse %s template", name)}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", errors.Wrapf(err, "Failed to render %s template", name)
+	}
+	return buf.String(), nil
+}
+
+// renderTemplates returns the startup script and user-data, rendered if --kamatera-template is set
+func (d *Driver) renderTemplates() (string, string, error) {
+	if ! d.Template {
+		return d.StartupScript, d.UserData, nil
+	}
+	data, err := d.templateData()
+	if err != nil {return "", "", err}
+	script, err := RenderTemplate("startup script", d.StartupScript, data)
+	if err != nil {return "", "", err}
+	userData, err := RenderTemplate("user-data", d.UserData, data)
+	if err != nil {return "", "", err}
+	return script, userData, nil
+}
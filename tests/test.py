@@ -1,5 +1,6 @@
 #!/usr/bin/env python3.6
 import os
+import re
 import subprocess
 import binascii
 import datetime
@@ -12,8 +13,8 @@ import time
 
 
 TEST_PLAN = [
-    # create
-    ('create', {'returncode': 0}),
+    # create (with debug output which must not contain any secrets)
+    ('create', {'returncode': 0, 'no_secrets': True}),
     ('hello-world', {'returncode': 0}),
 
     # restart
@@ -178,11 +179,13 @@ def get_cmd(cmd, assertions):
 def run_cmd(cmd, env, assertions, cmd_timeout_seconds):
     info('Running cmd:', cmd, env, assertions, cmd_timeout_seconds)
     try:
-        if 'output' in assertions:
+        if 'output' in assertions or 'no_secrets' in assertions:
             p = subprocess.run(cmd, timeout=cmd_timeout_seconds, env=env,
                                stdout=subprocess.PIPE, stderr=subprocess.STDOUT)
             returncode = p.returncode
             output = p.stdout.decode().strip()
+            if 'no_secrets' in assertions:
+                print(output)
         else:
             p = subprocess.run(cmd, timeout=cmd_timeout_seconds, env=env)
             returncode = p.returncode
@@ -201,6 +204,28 @@ def run_cmd(cmd, env, assertions, cmd_timeout_seconds):
     return returncode, output
 
 
+def get_secrets():
+    secrets = [os.environ['KAMATERA_API_SECRET']]
+    machine_path = KAMATERA_DOCKER_MACHINE_PATH_TEMPLATE.format(machine_name=machine_name)
+    for key_file in ['id_rsa', 'id_rsa.pub']:
+        key_file = os.path.join(machine_path, key_file)
+        if os.path.exists(key_file):
+            with open(key_file) as f:
+                # the base64 lines of private key / the base64 part of the public key
+                secrets += [line.strip() for line in f.read().splitlines()
+                            if len(line.strip()) > 20 and not line.startswith('-----')]
+    return secrets
+
+
+def find_secrets(output):
+    found = [secret[:4] + '...' for secret in get_secrets() if secret in output]
+    if re.search(r'PRIVATE KEY-----(\\n|\s)*[0-9A-Za-z+/]{20}', output):
+        found.append('PRIVATE KEY')
+    if re.search(r'"password(Validate)?": ?"(?!\*\*\*")', output):
+        found.append('password')
+    return found
+
+
 def run_test(test_num, test, errors, num_retries=0):
     cmd, assertions = test
     if cmd == 'create' and KAMATERA_TEST_CREATED_MACHINE_NAME:
@@ -228,6 +253,15 @@ def run_test(test_num, test, errors, num_retries=0):
                         )
                     )
                     print(_errors[-1])
+            elif assertion == 'no_secrets':
+                found_secrets = find_secrets(output)
+                if expected_value and len(found_secrets) > 0:
+                    _errors.append(
+                        '({}) failed: cmd = "{}", assertion = "{}", found secrets in output: {}'.format(
+                            test_num, cmd, assertion, found_secrets
+                        )
+                    )
+                    print(_errors[-1])
             elif assertion == 'output':
                 assert type(expected_value) == str
                 expected_value = expected_value.format(machine_name=machine_name)
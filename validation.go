@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// size limits of the startup script and the user-data set by the driver, Kamatera doesn't
+// document a limit. Some of the startup script size is reserved for the driver's host key prelude
+const (
+	maxUserDataSize = 64 * 1024
+	maxStartupScriptSize = 64 * 1024 - 2048
+)
+
+// top-level keys of the cloud-init modules and settings
+var cloudConfigKeys = []string{
+	"allow_public_ssh_keys", "ansible", "apk_repos", "apt", "apt_pipelining", "apt_preserve_sources_list",
+	"apt_reboot_if_required", "apt_update", "apt_upgrade", "autoinstall", "bootcmd", "byobu_by_default",
+	"ca-certs", "ca_certs", "chef", "chpasswd", "cloud_config_modules", "cloud_final_modules",
+	"cloud_init_modules", "create_hostname_file", "datasource", "datasource_list", "debconf_selections",
+	"device_aliases", "disable_ec2_metadata", "disable_root", "disable_root_opts", "disk_setup", "drivers",
+	"fan", "final_message", "fqdn", "fs_setup", "groups", "growpart", "hostname", "keyboard", "landscape",
+	"locale", "locale_configfile", "lxd", "manage_etc_hosts", "manage_resolv_conf", "mcollective",
+	"merge_how", "merge_type", "mount_default_fields", "mounts", "network", "no_ssh_fingerprints", "ntp",
+	"output", "package_reboot_if_required", "package_update", "package_upgrade", "packages", "password",
+	"phone_home", "power_state", "prefer_fqdn_over_hostname", "preserve_hostname", "puppet", "random_seed",
+	"reporting", "resize_rootfs", "resolv_conf", "rh_subscription", "rsyslog", "runcmd", "salt_minion",
+	"seed_random", "snap", "spacewalk", "ssh", "ssh_authorized_keys", "ssh_deletekeys", "ssh_fp_console_blacklist",
+	"ssh_genkeytypes", "ssh_import_id", "ssh_key_console_blacklist", "ssh_keys", "ssh_publish_hostkeys",
+	"ssh_pwauth", "ssh_quiet_keygen", "swap", "system_info", "timezone", "ubuntu_advantage", "ubuntu_pro",
+	"updates", "user", "users", "vendor_data", "wireguard", "write_files", "yum_repo_dir", "yum_repos", "zypper",
+}
+
+// ValidateCloudConfig parses a #cloud-config document and checks its top-level keys, unknown keys
+// are only a warning as cloud-init accepts keys which aren't in the list (e.g. legacy apt_sources)
+func ValidateCloudConfig(content string, source string) error {
+	var config map[string]interface{}
+	if err := yaml.Unmarshal([]byte(content), &config); err != nil {
+		return errors.Wrapf(err, "Invalid cloud-config YAML in %s", source)
+	}
+	var unknownKeys []string
+	for key := range config {
+		if ! IsStringInArray(key, cloudConfigKeys) {
+			unknownKeys = append(unknownKeys, key)
+		}
+	}
+	if len(unknownKeys) > 0 {
+		sort.Strings(unknownKeys)
+		log.Warnf("Unknown cloud-config keys in %s: %s", source, strings.Join(unknownKeys, ", "))
+	}
+	return nil
+}
+
+// ValidateScript checks the shebang line of a script, a script without shebang runs with /bin/sh
+func ValidateScript(content string, source string) error {
+	firstLine := strings.SplitN(content, "\n", 2)[0]
+	if strings.HasSuffix(firstLine, "\r") {
+		return errors.Errorf("Invalid %s: script has Windows (CRLF) line endings", source)
+	}
+	if ! strings.HasPrefix(firstLine, "#!") {
+		log.Warnf("%s has no shebang line, it will run with /bin/sh", source)
+		return nil
+	}
+	interpreter := strings.Fields(strings.TrimPrefix(firstLine, "#!"))
+	if len(interpreter) == 0 || ! strings.HasPrefix(interpreter[0], "/") {
+		return errors.Errorf("Invalid %s: shebang line must start with an absolute interpreter path: %s", source, firstLine)
+	}
+	return nil
+}
+
+// ValidateUserData validates user-data according to its cloud-init format
+func ValidateUserData(content string, source string) error {
+	firstLine := strings.TrimSpace(strings.SplitN(content, "\n", 2)[0])
+	switch {
+	case strings.HasPrefix(content, "\x1f\x8b"):
+		// gzip compressed user-data is not validated
+		return nil
+	case firstLine == "#cloud-config":
+		return ValidateCloudConfig(content, source)
+	case strings.HasPrefix(firstLine, "## template: jinja"):
+		// jinja templated cloud-config can't be parsed before it's rendered by cloud-init
+		return nil
+	case strings.HasPrefix(firstLine, "#!"):
+		return ValidateScript(content, source)
+	case firstLine == "#cloud-config-archive":
+		var parts []map[string]interface{}
+		if err := yaml.Unmarshal([]byte(content), &parts); err != nil {
+			return errors.Wrapf(err, "Invalid cloud-config-archive YAML in %s", source)
+		}
+		return nil
+	case firstLine == "#include" || firstLine == "#include-once" || firstLine == "#cloud-boothook" || firstLine == "#part-handler":
+		return nil
+	case strings.HasPrefix(strings.ToLower(content), "content-type:") || strings.HasPrefix(strings.ToLower(content), "mime-version:"):
+		return ValidateMultipartUserData(content, source)
+	default:
+		return errors.Errorf("Unrecognized %s format, expected #cloud-config, a script (#!) or MIME multipart", source)
+	}
+}
+
+// ValidateMultipartUserData validates every part of MIME multipart user-data
+func ValidateMultipartUserData(content string, source string) error {
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(content)))
+	if err != nil {return errors.Wrapf(err, "Invalid MIME multipart %s", source)}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || ! strings.HasPrefix(mediaType, "multipart/") {
+		return errors.Errorf("Invalid MIME multipart %s: expected multipart Content-Type", source)
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for i := 1; ; i++ {
+		part, err := reader.NextPart()
+		if err != nil {
+			if err == io.EOF {return nil}
+			return errors.Wrapf(err, "Invalid MIME multipart %s", source)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {return errors.Wrapf(err, "Invalid MIME multipart %s", source)}
+		partSource := fmt.Sprintf("%s part %d", source, i)
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "text/cloud-config":
+			if err := ValidateCloudConfig(string(bytes.TrimSpace(body)), partSource); err != nil {return err}
+		case "text/x-shellscript", "text/x-shellscript-per-boot", "text/x-shellscript-per-instance", "text/x-shellscript-per-once":
+			if err := ValidateScript(string(body), partSource); err != nil {return err}
+		}
+	}
+}
+
+// validateInitInputs validates the (rendered) startup script and user-data before creation
+func (d *Driver) validateInitInputs(script string, userData string) error {
+	if len(script) > maxStartupScriptSize {
+		return errors.Errorf("Startup script is too large: %d bytes (the driver allows up to %d bytes)", len(script), maxStartupScriptSize)
+	}
+	if len(userData) > maxUserDataSize {
+		return errors.Errorf("User-data is too large: %d bytes (the driver allows up to %d bytes)", len(userData), maxUserDataSize)
+	}
+	if d.SkipInitValidation {return nil}
+	if script != "" {
+		if err := ValidateScript(script, "startup script"); err != nil {return err}
+	}
+	if userData != "" {
+		if err := ValidateUserData(userData, "user-data"); err != nil {return err}
+	}
+	return nil
+}